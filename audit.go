@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//auditEntry records who changed what and how it went. Entries are never updated or removed.
+type auditEntry struct {
+	Id         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"targetType"` //pi, disk or bakeform
+	Target     string    `json:"target"`
+	Status     int       `json:"status"` //HTTP status of the response
+	Result     string    `json:"result"` //success or failure
+	Error      string    `json:"error,omitempty"`
+}
+
+type auditFilter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	Target     string
+	Result     string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+const maxAuditError = 1024
+
+//auditLog records the mutating API calls in the inventory
+type auditLog struct {
+	store inventoryStore
+}
+
+func newAuditLog(store inventoryStore) *auditLog {
+	return &auditLog{store: store}
+}
+
+type auditContextKey struct{}
+
+//auditRecorder keeps the status and error message a handler responds with
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	if a.status >= 400 && len(a.body) < maxAuditError {
+		a.body = append(a.body, b...)
+	}
+	return a.ResponseWriter.Write(b)
+}
+
+//setAuditTarget names the target of an audited call when it is not part of the URL, like the pi picked from the fridge
+func setAuditTarget(r *http.Request, target string) {
+	if entry, ok := r.Context().Value(auditContextKey{}).(*auditEntry); ok {
+		entry.Target = target
+	}
+}
+
+//auditActor is the user given by the client in X-Bakery-User, or the address the call came from
+func auditActor(r *http.Request) string {
+	if user := r.Header.Get("X-Bakery-User"); user != "" {
+		return user
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//record wraps a mutating handler so every call to it ends up in the audit log. The target is taken from the URL variable of its type.
+func (a *auditLog) record(action, targetType string, h http.HandlerFunc) http.HandlerFunc {
+	targetVar := map[string]string{"pi": "piId", "disk": "diskId", "bakeform": "name"}[targetType]
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := &auditEntry{
+			Time:       time.Now().UTC(),
+			Actor:      auditActor(r),
+			Action:     action,
+			TargetType: targetType,
+			Target:     mux.Vars(r)[targetVar],
+		}
+
+		recorder := &auditRecorder{ResponseWriter: w}
+		h(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, entry)))
+
+		entry.Status = recorder.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Result = "success"
+		if entry.Status >= 400 {
+			entry.Result = "failure"
+			entry.Error = string(recorder.body)
+			if len(entry.Error) > maxAuditError {
+				entry.Error = entry.Error[:maxAuditError]
+			}
+		}
+
+		err := a.store.AppendAudit(*entry)
+		if err != nil {
+			log.Printf("Unable to write audit entry for %v %v %v by %v: %v\n", action, targetType, entry.Target, entry.Actor, err)
+		}
+	}
+}
+
+//ListHandler returns the audit log, newest first. It can be filtered on actor, action, targetType, target, result and a since/until time range (RFC 3339).
+func (a *auditLog) ListHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := auditFilter{
+		Actor:      query.Get("actor"),
+		Action:     query.Get("action"),
+		TargetType: query.Get("targetType"),
+		Target:     query.Get("target"),
+		Result:     query.Get("result"),
+		Limit:      100,
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("since should be an RFC 3339 time"))
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("until should be an RFC 3339 time"))
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 || filter.Limit > 1000 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("limit should be between 1 and 1000"))
+			return
+		}
+	}
+
+	entries, err := a.store.ListAudit(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	jsonBytes, err := json.Marshal(entries)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
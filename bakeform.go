@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -8,6 +9,8 @@ import (
 	"regexp"
 	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Bakeform struct {
@@ -38,11 +41,14 @@ func (b *Bakeform) Delete() error {
 	return os.Remove(b.Location)
 }
 
-func (b *Bakeform) mount() error {
+func (b *Bakeform) mount(ctx context.Context) (err error) {
 	if len(b.MountedOn) >= 2 {
 		return nil
 	}
 
+	_, span := startSpan(ctx, "Bakeform.mount", attribute.String("bakery.bakeform", b.Name))
+	defer func() { endSpan(span, err) }()
+
 	//raspbian images have 2 partitions. before mounting we need to map them to devices
 	out, err := exec.Command(b.kpartxPath, "-av", b.Location).CombinedOutput()
 	if err != nil {
@@ -75,7 +81,7 @@ func (b *Bakeform) mount() error {
 			}
 		}
 
-		log.Printf("Mounting %v on %v\n", loopDevice, mountTarget)
+		loggerFrom(ctx).Info("Mounting bakeform partition", "bakeform", b.Name, "device", loopDevice, "mountPoint", mountTarget)
 		err = syscall.Mount(loopDevice, mountTarget, "vfat", 0, "")
 		if err != nil && err.Error() != "device or resource busy" { //already mounted if this error occurs. Just continue :){
 			err = syscall.Mount(loopDevice, mountTarget, "ext4", 0, "")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/mux"
 )
@@ -18,6 +20,7 @@ type bakeformInventory interface {
 	Load() error //loads alls images from the image folder
 	List() BakeformList
 	UnmountAll() error
+	Capture(name string, source *Bakeform, rootPath string, progress func(step string, percent int)) error
 	ListHandler(w http.ResponseWriter, r *http.Request)
 	UploadHandler(w http.ResponseWriter, r *http.Request)
 	DeleteHandler(w http.ResponseWriter, r *http.Request)
@@ -29,9 +32,12 @@ type BakeformInventory struct {
 	nfs        fileBackend
 	Content    BakeformList
 	kpartxPath string
+	bus        *eventBus
+	mutex      *sync.RWMutex //guards Content
+	loadMutex  *sync.Mutex   //one Load at a time
 }
 
-func newBakeformInventory(folder, mountRoot string, nfs fileBackend, kpartxPath string) (bakeformInventory, error) {
+func newBakeformInventory(folder, mountRoot string, nfs fileBackend, kpartxPath string, bus *eventBus) (bakeformInventory, error) {
 	if mountRoot == "" || folder == "" {
 		return &BakeformInventory{}, fmt.Errorf("Please set IMAGE_FOLDER and IMAGE_MOUNT_ROOT en vars.")
 	}
@@ -40,7 +46,11 @@ func newBakeformInventory(folder, mountRoot string, nfs fileBackend, kpartxPath
 		folder:     folder,
 		mountRoot:  mountRoot,
 		nfs:        nfs,
+		Content:    make(BakeformList),
 		kpartxPath: kpartxPath,
+		bus:        bus,
+		mutex:      &sync.RWMutex{},
+		loadMutex:  &sync.Mutex{},
 	}
 
 	err := newInv.Load()
@@ -51,17 +61,28 @@ func newBakeformInventory(folder, mountRoot string, nfs fileBackend, kpartxPath
 	return newInv, err
 }
 
+//Load adds the images that appeared in the image folder and drops the ones that are gone. Bakeforms that are already
+//loaded are kept as they are, they can be mounted for a bake that is running.
 func (i *BakeformInventory) Load() error {
+	i.loadMutex.Lock()
+	defer i.loadMutex.Unlock()
+
 	imgFiles, err := filepath.Glob(i.folder + "/*.img")
 	if err != nil {
 		return err
 	}
 
-	list := make(BakeformList)
+	known := i.List()
+	found := make(map[string]bool)
 
 	for _, img := range imgFiles {
 		nameParts := strings.Split(img, "/")
 		name := strings.Replace(nameParts[len(nameParts)-1], ".img", "", 1)
+		found[name] = true
+
+		if _, exists := known[name]; exists {
+			continue
+		}
 
 		log.Printf("Loading image %v\n", name)
 		bf := &Bakeform{
@@ -75,28 +96,57 @@ func (i *BakeformInventory) Load() error {
 
 		_, err := os.Stat(bf.bootLocation)
 		if os.IsNotExist(err) {
-			err := bf.mount()
+			i.publish(name, "extracting boot partition")
+			err := bf.mount(context.Background())
 			if err != nil {
+				i.publish(name, "failed: "+err.Error())
 				return err
 			}
 
-			_, err = i.nfs.CopyBootFolder(bf.MountedOn[0]+"/", name)
+			_, err = i.nfs.CopyBootFolder(context.Background(), bf.MountedOn[0]+"/", name)
 			bf.unmount()
 			if err != nil {
+				i.publish(name, "failed: "+err.Error())
 				return err
 			}
 		}
 
-		list[name] = bf
+		i.mutex.Lock()
+		i.Content[name] = bf
+		i.mutex.Unlock()
+		i.publish(name, "ready")
 	}
 
-	i.Content = list
+	for name := range known {
+		if !found[name] {
+			i.mutex.Lock()
+			delete(i.Content, name)
+			i.mutex.Unlock()
+			i.publish(name, "removed")
+		}
+	}
 
 	return nil
 }
 
+func (i *BakeformInventory) publish(name, detail string) {
+	i.bus.Publish(busEvent{
+		Type:     eventBakeform,
+		Bakeform: name,
+		Detail:   detail,
+	})
+}
+
+//List returns a copy of the bakeforms, safe to use while images are loaded
 func (i *BakeformInventory) List() BakeformList {
-	return i.Content
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	list := make(BakeformList, len(i.Content))
+	for name, bf := range i.Content {
+		list[name] = bf
+	}
+	return list
 }
 
 func (i *BakeformInventory) ListHandler(w http.ResponseWriter, r *http.Request) {
@@ -105,7 +155,7 @@ func (i *BakeformInventory) ListHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	jsonBytes, err := json.Marshal(i.Content)
+	jsonBytes, err := json.Marshal(i.List())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -121,6 +171,7 @@ func (i *BakeformInventory) UploadHandler(w http.ResponseWriter, r *http.Request
 	filepath := i.folder + "/" + name + ".img"
 
 	log.Println("Receiving upload: " + filepath)
+	i.publish(name, "uploading")
 
 	file, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
@@ -133,6 +184,7 @@ func (i *BakeformInventory) UploadHandler(w http.ResponseWriter, r *http.Request
 	_, err = io.Copy(file, r.Body)
 	if err != nil {
 		log.Printf("Error saving image: %v\n", err)
+		i.publish(name, "failed: "+err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
@@ -146,7 +198,7 @@ func (i *BakeformInventory) UploadHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	jsonBytes, _ := json.Marshal(i.Content[name])
+	jsonBytes, _ := json.Marshal(i.List()[name])
 	w.WriteHeader(http.StatusCreated)
 	w.Write(jsonBytes)
 }
@@ -155,7 +207,7 @@ func (i *BakeformInventory) DeleteHandler(w http.ResponseWriter, r *http.Request
 	urlvars := mux.Vars(r)
 	name := urlvars["name"]
 
-	bf, exists := i.Content[name]
+	bf, exists := i.List()[name]
 	if !exists {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Bakeform not found"))
@@ -179,7 +231,7 @@ func (i *BakeformInventory) DeleteHandler(w http.ResponseWriter, r *http.Request
 }
 
 func (i *BakeformInventory) UnmountAll() error {
-	for _, b := range i.Content {
+	for _, b := range i.List() {
 		b.unmount()
 	}
 	return nil
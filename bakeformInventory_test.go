@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadKeepsLoadedBakeforms(t *testing.T) {
+	dir := t.TempDir()
+	images := path.Join(dir, "images")
+	boot := path.Join(dir, "boot")
+
+	//with their boot partition extracted, images are loaded without mounting them
+	for _, folder := range []string{images, path.Join(boot, "raspbian"), path.Join(boot, "dietpi")} {
+		err := os.MkdirAll(folder, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	addImage := func(name string) {
+		err := ioutil.WriteFile(path.Join(images, name+".img"), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	addImage("raspbian")
+
+	fb, err := newFileBackend("127.0.0.1", path.Join(dir, "nfs"), boot, "3", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inventory, err := newBakeformInventory(images, path.Join(dir, "mnt"), fb, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a bake is using the bakeform while another image is uploaded
+	raspbian := inventory.List()["raspbian"]
+	raspbian.MountedOn = []string{"/mnt/boot", "/mnt/root"}
+	addImage("dietpi")
+
+	err = inventory.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := inventory.List()
+	if list["raspbian"] != raspbian || len(list["raspbian"].MountedOn) != 2 {
+		t.Error("reloading replaced a bakeform that was in use")
+	}
+	if list["dietpi"] == nil {
+		t.Error("the new image was not loaded")
+	}
+
+	err = os.Remove(path.Join(images, "dietpi.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inventory.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := inventory.List()["dietpi"]; exists {
+		t.Error("a removed image is still listed")
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+)
+
+type diskMode string
+
+type diskMount struct {
+	refs     int
+	readOnly bool
+}
+
+const (
+	nfsDisk   diskMode = "nfs"   //a folder shared with the pi over NFS
+	blockDisk diskMode = "block" //a disk.img exported to the pi over NBD
+)
+
+func parseDiskMode(mode string) (diskMode, error) {
+	switch diskMode(mode) {
+	case "", nfsDisk:
+		return nfsDisk, nil
+	case blockDisk:
+		return blockDisk, nil
+	}
+
+	return "", fmt.Errorf("Unknown disk mode %v", mode)
+}
+
+func createSparseFile(filePath string, sizeInBytes int64) error {
+	fd, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("Failed to create disk")
+	}
+	defer fd.Close()
+
+	err = fd.Truncate(sizeInBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to size disk. %v", err)
+	}
+
+	return nil
+}
+
+//EnableNbd sets up the NBD server that exports block disks. The caller starts it with ListenAndServe.
+func (dm *diskManager) EnableNbd(address string) (*nbdServer, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	dm.nbd = newNbdServer(address, dm)
+	dm.nbdPort = port
+
+	return dm.nbd, nil
+}
+
+//NbdEnabled returns true if block disks can be used by pis
+func (dm *diskManager) NbdEnabled() bool {
+	return dm.nbd != nil
+}
+
+var errDiskInUse = errors.New("Disk is in use by a pi")
+
+//openExport implements nbdExports. Export names are disk ids, a disk is only opened for the pi it is attached to and only once.
+func (dm *diskManager) openExport(name, client string) (*os.File, error) {
+	dsk, exists := dm.GetDisk(name)
+	if !exists || dsk.Mode != blockDisk {
+		return nil, fmt.Errorf("Disk with id %v not found", name)
+	}
+
+	dm.mountMutex.Lock()
+	defer dm.mountMutex.Unlock()
+
+	//disks mounted on the server are shared over NFS, a second writer would corrupt them
+	if _, mounted := dm.mounts[name]; mounted || dm.exclusive[name] {
+		return nil, fmt.Errorf("Disk with id %v is in use", name)
+	}
+	if !slices.Contains(dm.exportClients[name], client) {
+		return nil, fmt.Errorf("Disk with id %v is not exported to %v", name, client)
+	}
+	//two pis writing the same ext4 image corrupt it
+	if dm.exportRefs[name] > 0 {
+		return nil, fmt.Errorf("%w: %v", errDiskInUse, name)
+	}
+
+	file, err := os.OpenFile(path.Join(dsk.Location, "disk.img"), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	dm.exportRefs[name]++
+	return file, nil
+}
+
+//closeExport implements nbdExports
+func (dm *diskManager) closeExport(name string) {
+	dm.mountMutex.Lock()
+	defer dm.mountMutex.Unlock()
+
+	dm.exportRefs[name]--
+	if dm.exportRefs[name] <= 0 {
+		delete(dm.exportRefs, name)
+	}
+}
+
+func (dm *diskManager) nbdInUse(id string) bool {
+	dm.mountMutex.Lock()
+	defer dm.mountMutex.Unlock()
+
+	return dm.exportRefs[id] > 0
+}
+
+//lockExclusive reserves a block disk for a change to its disk.img. It fails if a pi uses the disk, while it is reserved pis can't connect to it.
+func (dm *diskManager) lockExclusive(id string) error {
+	dm.mountMutex.Lock()
+	defer dm.mountMutex.Unlock()
+
+	if dm.exportRefs[id] > 0 {
+		return fmt.Errorf("%w: %v", errDiskInUse, id)
+	}
+	if dm.exclusive[id] {
+		return fmt.Errorf("Disk with id %v is busy", id)
+	}
+
+	dm.exclusive[id] = true
+	return nil
+}
+
+func (dm *diskManager) unlockExclusive(id string) {
+	dm.mountMutex.Lock()
+	defer dm.mountMutex.Unlock()
+
+	delete(dm.exclusive, id)
+}
+
+//blockDiskFromFolder creates an ext4 formatted disk.img with the contents of a folder of a bakeform
+func (dm *diskManager) blockDiskFromFolder(ctx context.Context, id, source, bakeform string) (*disk, error) {
+	location, err := dm.fb.CreateNfsFolder(ctx, id)
+	if err != nil {
+		return &disk{}, err
+	}
+
+	img := path.Join(location, "disk.img")
+	err = createSparseFile(img, int64(dm.blockRootSize)*1024*1024)
+	if err != nil {
+		dm.fb.DeleteNfsFolder(ctx, id)
+		return &disk{}, err
+	}
+
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-L", "rootfs", "-d", source, img).CombinedOutput()
+	if err != nil {
+		dm.fb.DeleteNfsFolder(ctx, id)
+		return &disk{}, fmt.Errorf("Unable to create root filesystem: %v %v", err, string(out))
+	}
+
+	return dm.RegisterDisk(ctx, id, location, bakeform, "")
+}
+
+//withDiskRoot calls fn with a path where the contents of the disk can be accessed. Block disks are loop mounted for the duration of the call.
+//A block disk that is in use by a pi can only be accessed read only.
+func (dm *diskManager) withDiskRoot(dsk *disk, readOnly bool, fn func(root string) error) error {
+	if dsk.Mode != blockDisk {
+		return fn(dsk.Location)
+	}
+
+	if !readOnly && dm.nbdInUse(dsk.ID) {
+		return fmt.Errorf("Disk with id %v is in use by a pi", dsk.ID)
+	}
+
+	mountPoint, err := dm.mountDisk(dsk, readOnly)
+	if err != nil {
+		return err
+	}
+	defer dm.unmountDisk(dsk)
+
+	return fn(mountPoint)
+}
+
+//mountDisk loop mounts the disk.img of a block disk on {location}/mnt. Mounts are reference counted, every mountDisk needs an unmountDisk.
+func (dm *diskManager) mountDisk(dsk *disk, readOnly bool) (string, error) {
+	dm.mountMutex.Lock()
+	defer dm.mountMutex.Unlock()
+
+	mountPoint := path.Join(dsk.Location, "mnt")
+
+	if !readOnly && dm.exportRefs[dsk.ID] > 0 {
+		return "", fmt.Errorf("%w: %v", errDiskInUse, dsk.ID)
+	}
+
+	if m, mounted := dm.mounts[dsk.ID]; mounted {
+		if m.readOnly && !readOnly {
+			return "", fmt.Errorf("Disk with id %v is mounted read only", dsk.ID)
+		}
+		m.refs++
+		return mountPoint, nil
+	}
+
+	err := os.MkdirAll(mountPoint, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	//skip journal replay, so a read only mount never writes to a disk a pi is using
+	options := "loop"
+	if readOnly {
+		options = "loop,ro,noload"
+		if dsk.FsType == "xfs" {
+			options = "loop,ro,norecovery"
+		}
+	}
+
+	out, err := exec.Command("mount", "-o", options, path.Join(dsk.Location, "disk.img"), mountPoint).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Unable to mount disk %v: %v %v", dsk.ID, err, string(out))
+	}
+
+	dm.mounts[dsk.ID] = &diskMount{refs: 1, readOnly: readOnly}
+	return mountPoint, nil
+}
+
+func (dm *diskManager) unmountDisk(dsk *disk) error {
+	dm.mountMutex.Lock()
+	defer dm.mountMutex.Unlock()
+
+	m, mounted := dm.mounts[dsk.ID]
+	if !mounted {
+		return nil
+	}
+
+	m.refs--
+	if m.refs > 0 {
+		return nil
+	}
+
+	delete(dm.mounts, dsk.ID)
+	out, err := exec.Command("umount", path.Join(dsk.Location, "mnt")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to unmount disk %v: %v %v", dsk.ID, err, string(out))
+	}
+
+	return nil
+}
+
+//releaseDisk drops all mounts of a disk, regardless of who holds them
+func (dm *diskManager) releaseDisk(dsk *disk) error {
+	dm.mountMutex.Lock()
+	m, mounted := dm.mounts[dsk.ID]
+	if mounted {
+		m.refs = 1
+	}
+	dm.mountMutex.Unlock()
+
+	return dm.unmountDisk(dsk)
+}
+
+func (dm *diskManager) isMounted(id string) bool {
+	dm.mountMutex.Lock()
+	defer dm.mountMutex.Unlock()
+
+	_, mounted := dm.mounts[id]
+	return mounted
+}
+
+//ResizeDisk grows the disk.img of a block disk to size MB, including the filesystem on it.
+//Disks that are mounted on the server are grown online, disks in use by a pi over NBD can't be resized.
+func (dm *diskManager) ResizeDisk(id string, size int) error {
+	dsk, exists := dm.GetDisk(id)
+	if !exists {
+		return fmt.Errorf("Disk with id %v not found", id)
+	}
+
+	if dsk.Mode != blockDisk {
+		return fmt.Errorf("Disk with id %v is not a block disk and has no size", id)
+	}
+	if int64(size) <= dsk.Size {
+		return fmt.Errorf("Disks can only grow, disk %v is %v MB", id, dsk.Size)
+	}
+	err := dm.lockExclusive(id)
+	if err != nil {
+		return err
+	}
+	defer dm.unlockExclusive(id)
+
+	log.Printf("Growing disk %v to %v MB\n", id, size)
+	err = os.Truncate(path.Join(dsk.Location, "disk.img"), int64(size)*1024*1024)
+	if err != nil {
+		return fmt.Errorf("Failed to size disk. %v", err)
+	}
+
+	if dsk.FsType != "" {
+		err = dm.growFilesystem(dsk)
+	}
+
+	dm.disksMutex.Lock()
+	dsk.Size = dm.getDiskSize(dsk.Location)
+	dm.disksMutex.Unlock()
+
+	return err
+}
+
+//growFilesystem grows the filesystem on a block disk to fill its disk.img
+func (dm *diskManager) growFilesystem(dsk *disk) error {
+	img := path.Join(dsk.Location, "disk.img")
+	mountPoint := path.Join(dsk.Location, "mnt")
+
+	var cmds [][]string
+	if dm.isMounted(dsk.ID) {
+		//the loop device has to pick up the new size of the image first
+		out, err := exec.Command("findmnt", "-n", "-o", "SOURCE", mountPoint).Output()
+		if err != nil {
+			return fmt.Errorf("Unable to find the loop device of disk %v: %v", dsk.ID, err)
+		}
+		loopDevice := strings.TrimSpace(string(out))
+
+		cmds = append(cmds, []string{"losetup", "-c", loopDevice})
+		if dsk.FsType == "xfs" {
+			cmds = append(cmds, []string{"xfs_growfs", mountPoint})
+		} else {
+			cmds = append(cmds, []string{"resize2fs", loopDevice})
+		}
+	} else if dsk.FsType == "xfs" {
+		//xfs can only be grown while mounted
+		_, err := dm.mountDisk(dsk, false)
+		if err != nil {
+			return err
+		}
+		defer dm.unmountDisk(dsk)
+
+		cmds = append(cmds, []string{"xfs_growfs", mountPoint})
+	} else {
+		cmds = append(cmds, []string{"e2fsck", "-f", "-p", img}, []string{"resize2fs", img})
+	}
+
+	for _, cmd := range cmds {
+		out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+		if err != nil && !(cmd[0] == "e2fsck" && err.Error() == "exit status 1") { //e2fsck fixed errors, the filesystem is fine now
+			return fmt.Errorf("Unable to grow filesystem of disk %v: %v %v", dsk.ID, err, string(out))
+		}
+	}
+
+	return nil
+}
+
+//formatDisk creates a filesystem on the disk.img of a block disk
+func formatDisk(img, fsType string) error {
+	var cmd *exec.Cmd
+	switch fsType {
+	case "ext4":
+		cmd = exec.Command("mkfs.ext4", "-q", "-F", img)
+	case "xfs":
+		cmd = exec.Command("mkfs.xfs", "-q", "-f", img)
+	default:
+		return fmt.Errorf("Unsupported filesystem %v", fsType)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to format disk: %v %v", err, string(out))
+	}
+
+	return nil
+}
+
+//detectFsType returns the filesystem on a disk image, or an empty string if it is not formatted
+func detectFsType(img string) string {
+	out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", img).Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//bootConfig holds per pi additions to the boot files of its bakeform. They are applied the next time the pi boots.
+type bootConfig struct {
+	Cmdline string   `json:"cmdline,omitempty"` //appended to the kernel command line in cmdline.txt
+	Config  []string `json:"config,omitempty"`  //lines appended to config.txt, e.g. dtoverlay=...
+}
+
+func (bc *bootConfig) isEmpty() bool {
+	return bc == nil || (bc.Cmdline == "" && len(bc.Config) == 0)
+}
+
+func (bc *bootConfig) validate() error {
+	if strings.ContainsAny(bc.Cmdline, "\r\n") {
+		return fmt.Errorf("cmdline must be a single line")
+	}
+
+	for _, line := range bc.Config {
+		if strings.ContainsAny(line, "\r\n") {
+			return fmt.Errorf("config lines may not contain line breaks")
+		}
+	}
+
+	return nil
+}
+
+//appliesTo returns true if the boot config changes the given boot file
+func (bc *bootConfig) appliesTo(filename string) bool {
+	if bc.isEmpty() {
+		return false
+	}
+
+	return (filename == "cmdline.txt" && bc.Cmdline != "") || (filename == "config.txt" && len(bc.Config) > 0)
+}
+
+//merge adds the overrides to the content of a boot file
+func (bc *bootConfig) merge(filename string, content []byte) []byte {
+	if !bc.appliesTo(filename) {
+		return content
+	}
+
+	switch filename {
+	case "cmdline.txt":
+		//the kernel command line must stay on a single line
+		cmdline := bytes.TrimSpace(content)
+		return []byte(strings.TrimSpace(string(cmdline)+" "+bc.Cmdline) + "\n")
+	case "config.txt":
+		//[all] resets any conditional section the bakeform's config.txt may end with
+		merged := append(bytes.TrimRight(content, "\n"), []byte("\n\n#bakery per pi overrides\n[all]\n")...)
+		merged = append(merged, []byte(strings.Join(bc.Config, "\n")+"\n")...)
+		return merged
+	}
+
+	return content
+}
+
+func (pm *PiManager) GetBootConfigHandler(w http.ResponseWriter, r *http.Request) {
+	piId := mux.Vars(r)["piId"]
+
+	pi, err := pm.GetPi(piId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Pi not found"))
+		return
+	}
+
+	bc := pi.BootConfig
+	if bc == nil {
+		bc = &bootConfig{}
+	}
+
+	jsonBytes, err := json.Marshal(bc)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
+
+func (pm *PiManager) SetBootConfigHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	piId := mux.Vars(r)["piId"]
+
+	var bc bootConfig
+	err := json.NewDecoder(r.Body).Decode(&bc)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error parsing posted data"))
+		return
+	}
+
+	err = bc.validate()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	pi, err := pm.GetPi(piId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Pi not found"))
+		return
+	}
+
+	pi.BootConfig = &bc
+	if bc.isEmpty() {
+		pi.BootConfig = nil
+	}
+
+	err = pi.Save(r.Context())
+	if err != nil {
+		log.Printf("Error saving boot config of pi %v: %v\n", pi.Id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	jsonBytes, _ := json.Marshal(bc)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//captureJob tracks turning the root disk of a pi into a bakeform
+type captureJob struct {
+	PiId     string    `json:"piId"`
+	Name     string    `json:"name"`
+	Status   string    `json:"status"` //running, done or failed
+	Step     string    `json:"step"`
+	Progress int       `json:"progress"` //percentage
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	mutex    *sync.Mutex
+}
+
+func (j *captureJob) update(step string, progress int) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.Step = step
+	j.Progress = progress
+}
+
+func (j *captureJob) running() bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.Status == "running"
+}
+
+func (j *captureJob) finish(err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if err != nil {
+		j.Status = "failed"
+		j.Error = err.Error()
+		return
+	}
+
+	j.Status = "done"
+	j.Progress = 100
+}
+
+func (j *captureJob) MarshalJSON() ([]byte, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	type job captureJob
+	return json.Marshal((*job)(j))
+}
+
+var partitionRegexp = regexp.MustCompile("loop\\d+p\\d+")
+
+//Capture builds a new bakeform from the boot folder of source and the root filesystem at rootPath.
+//The image gets the disk identifier of source, so PARTUUIDs in the fstab and cmdline.txt of the root filesystem stay valid.
+func (i *BakeformInventory) Capture(name string, source *Bakeform, rootPath string, progress func(step string, percent int)) error {
+	if name == "" || strings.ContainsAny(name, "/.") {
+		return fmt.Errorf("Invalid bakeform name %v", name)
+	}
+
+	img := path.Join(i.folder, name+".img")
+	if _, err := os.Stat(img); err == nil {
+		return fmt.Errorf("Bakeform %v already exists", name)
+	}
+
+	//leave room for the pi to write to the root filesystem after baking
+	bootSize := diskUsage(source.bootLocation) + 64
+	if bootSize < 256 {
+		bootSize = 256
+	}
+	rootSize := diskUsage(rootPath)*13/10 + 512
+
+	partial := img + ".partial"
+	err := createSparseFile(partial, (bootSize+rootSize+4)*1024*1024)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partial)
+
+	progress("partitioning", 5)
+	labelId := ""
+	out, err := exec.Command("sfdisk", "-d", source.Location).Output()
+	if err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "label-id:") {
+				labelId = line + "\n"
+			}
+		}
+	}
+
+	layout := fmt.Sprintf("label: dos\n%vstart=8192, size=%v, type=c\nstart=%v, type=83\n", labelId, bootSize*2048, 8192+bootSize*2048)
+	cmd := exec.Command("sfdisk", partial)
+	cmd.Stdin = strings.NewReader(layout)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to partition image: %v %v", err, string(out))
+	}
+
+	out, err = exec.Command(i.kpartxPath, "-av", partial).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to map image: %v %v", err, string(out))
+	}
+	defer exec.Command(i.kpartxPath, "-d", partial).Run()
+
+	loops := partitionRegexp.FindAll(out, 2)
+	if len(loops) < 2 {
+		return fmt.Errorf("Image could not be mapped")
+	}
+	bootDevice := "/dev/mapper/" + string(loops[0])
+	rootDevice := "/dev/mapper/" + string(loops[1])
+
+	//same as mounting a bakeform, the mapped devices take a moment to show up
+	time.Sleep(1 * time.Second)
+
+	progress("formatting", 10)
+	out, err = exec.Command("mkfs.vfat", "-F", "32", "-n", "boot", bootDevice).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to format boot partition: %v %v", err, string(out))
+	}
+	out, err = exec.Command("mkfs.ext4", "-q", "-F", "-L", "rootfs", rootDevice).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to format root partition: %v %v", err, string(out))
+	}
+
+	mountTarget, err := ioutil.TempDir(i.mountRoot, "capture-"+name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mountTarget)
+
+	progress("copying boot partition", 15)
+	err = copyToPartition(bootDevice, "vfat", mountTarget, exec.Command("rsync", "-rt", "--info=progress2", "--no-inc-recursive", source.bootLocation+"/", mountTarget+"/"), func(percent int) {
+		progress("copying boot partition", 15+percent*15/100)
+	})
+	if err != nil {
+		return err
+	}
+
+	//copying the root filesystem takes most of the time of a capture
+	progress("copying root partition", 30)
+	err = copyToPartition(rootDevice, "ext4", mountTarget, exec.Command("rsync", "-aHAXx", "--numeric-ids", "--info=progress2", "--no-inc-recursive", rootPath+"/", mountTarget+"/"), func(percent int) {
+		progress("copying root partition", 30+percent*65/100)
+	})
+	if err != nil {
+		return err
+	}
+
+	progress("registering", 95)
+	exec.Command(i.kpartxPath, "-d", partial).Run()
+	err = os.Rename(partial, img)
+	if err != nil {
+		return err
+	}
+
+	return i.Load()
+}
+
+//copyToPartition mounts a partition on mountTarget and runs an rsync into it. progress is called with the percentage rsync reports.
+func copyToPartition(device, fsType, mountTarget string, rsync *exec.Cmd, progress func(percent int)) error {
+	err := syscall.Mount(device, mountTarget, fsType, 0, "")
+	if err != nil {
+		return fmt.Errorf("Unable to mount %v: %v", device, err)
+	}
+	defer syscall.Unmount(mountTarget, 0)
+
+	var stderr bytes.Buffer
+	rsync.Stderr = &stderr
+	stdout, err := rsync.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = rsync.Start()
+	if err != nil {
+		return fmt.Errorf("Unable to copy to %v: %v", device, err)
+	}
+
+	readRsyncProgress(stdout, progress)
+
+	err = rsync.Wait()
+	if err != nil && err.Error() != "exit status 23" { //same as copyFolder, files vanishing on a running pi are fine
+		return fmt.Errorf("Unable to copy to %v: %v %v", device, err, stderr.String())
+	}
+
+	return nil
+}
+
+var rsyncProgressRegexp = regexp.MustCompile(`\s(\d{1,3})%\s`)
+
+//readRsyncProgress reads the output of rsync --info=progress2 until it ends. rsync rewrites its progress line with carriage returns.
+func readRsyncProgress(r io.Reader, progress func(percent int)) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	last := -1
+	for scanner.Scan() {
+		match := rsyncProgressRegexp.FindSubmatch(scanner.Bytes())
+		if match == nil {
+			continue
+		}
+
+		percent, err := strconv.Atoi(string(match[1]))
+		if err == nil && percent != last && percent <= 100 {
+			last = percent
+			progress(percent)
+		}
+	}
+
+	//keep rsync from blocking on a full pipe if the output could not be scanned
+	io.Copy(ioutil.Discard, r)
+}
+
+//CaptureHandler starts turning the root disk of a pi into a new bakeform. Progress is reported by GetCaptureHandler.
+func (pm *PiManager) CaptureHandler(w http.ResponseWriter, r *http.Request) {
+	piId := mux.Vars(r)["piId"]
+
+	var params struct {
+		Name string `json:"name"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil || params.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please provide the name of the new bakeform"))
+		return
+	}
+
+	if _, exists := pm.bakeforms.List()[params.Name]; exists {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Bakeform already exists"))
+		return
+	}
+
+	pi, err := pm.GetPi(piId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Pi not found"))
+		return
+	}
+
+	if pi.Status != INUSE || len(pi.Disks) == 0 || pi.Disks[0] == nil || pi.SourceBakeform == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Pi is not baked"))
+		return
+	}
+
+	job := &captureJob{
+		PiId:    piId,
+		Name:    params.Name,
+		Status:  "running",
+		Started: time.Now().UTC(),
+		mutex:   &sync.Mutex{},
+	}
+
+	pm.captureMutex.Lock()
+	if running, exists := pm.captures[piId]; exists && running.running() {
+		pm.captureMutex.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Pi is already being captured"))
+		return
+	}
+	pm.captures[piId] = job
+	pm.captureMutex.Unlock()
+
+	go func() {
+		log.Printf("Capturing pi %v as bakeform %v\n", piId, params.Name)
+		//a pi can keep running, block disks it is using are mounted read only
+		err := pm.diskManager.withDiskRoot(pi.Disks[0], true, func(root string) error {
+			return pm.bakeforms.Capture(params.Name, pi.SourceBakeform, root, job.update)
+		})
+		if err != nil {
+			log.Printf("Unable to capture pi %v: %v\n", piId, err)
+		}
+		job.finish(err)
+	}()
+
+	jsonBytes, _ := json.Marshal(job)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(jsonBytes)
+}
+
+func (pm *PiManager) GetCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	piId := mux.Vars(r)["piId"]
+
+	pm.captureMutex.Lock()
+	job, exists := pm.captures[piId]
+	pm.captureMutex.Unlock()
+
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(job)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
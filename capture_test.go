@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRsyncProgress(t *testing.T) {
+	//rsync --info=progress2 redraws one line with carriage returns and ends it with a newline
+	output := "\r        32,768   0%    0.00kB/s    0:00:00  \r    52,428,800  12%   50.00MB/s    0:00:07 (xfr#120, to-chk=900/1024)" +
+		"\r    52,428,800  12%   50.00MB/s    0:00:07 (xfr#121, to-chk=899/1024)" +
+		"\r   419,430,400 100%   48.12MB/s    0:00:08 (xfr#1024, to-chk=0/1024)\n" +
+		"sent 419,512,345 bytes  received 20,480 bytes  49,356,803.00 bytes/sec\n"
+
+	var reported []int
+	readRsyncProgress(strings.NewReader(output), func(percent int) {
+		reported = append(reported, percent)
+	})
+
+	expected := []int{0, 12, 100}
+	if !reflect.DeepEqual(reported, expected) {
+		t.Errorf("reported %v, want %v", reported, expected)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+//Attached data disks are mounted by the pi over NFS. Block disks are mounted on the server first and shared from there.
+//Every disk gets an entry in the fstab of the pi's root disk, marked so it can be removed again on detach.
+
+const fstabMarker = "#bakery disk "
+
+func surfaceKey(root, dsk *disk) string {
+	return dsk.ID + "@" + root.ID
+}
+
+//diskMountPoint is where a data disk shows up on the pi
+func diskMountPoint(dsk *disk) string {
+	return path.Join("/mnt/disks", dsk.ID)
+}
+
+//rootInUse returns true if the fstab on root can't be changed, because root is a block disk a pi is using over NBD
+func (dm *diskManager) rootInUse(root *disk) bool {
+	return root.Mode == blockDisk && dm.nbdInUse(root.ID)
+}
+
+//SurfaceDisk makes a data disk available to the pi that boots from root
+func (dm *diskManager) SurfaceDisk(root, dsk *disk) error {
+	if dsk.Mode == blockDisk && dsk.FsType == "" {
+		return fmt.Errorf("Disk with id %v is not formatted", dsk.ID)
+	}
+
+	source := dsk.Location
+	if dsk.Mode == blockDisk {
+		source = path.Join(dsk.Location, "mnt")
+
+		key := surfaceKey(root, dsk)
+		dm.mountMutex.Lock()
+		alreadySurfaced := dm.surfaced[key]
+		dm.surfaced[key] = true
+		dm.mountMutex.Unlock()
+
+		if !alreadySurfaced {
+			_, err := dm.mountDisk(dsk, false)
+			if err != nil {
+				dm.mountMutex.Lock()
+				delete(dm.surfaced, key)
+				dm.mountMutex.Unlock()
+				return err
+			}
+		}
+	}
+
+	entry := fmt.Sprintf("%v:%v %v nfs defaults,nofail,%v 0 0", dm.fb.GetNfsAddress(), dm.fb.GetNfsPath(source), diskMountPoint(dsk), dm.fb.GetNfsOptions())
+	err := dm.withDiskRoot(root, false, func(rootPath string) error {
+		return editFstab(rootPath, dsk, entry)
+	})
+	if err != nil {
+		dm.UnsurfaceDisk(root, dsk)
+		return err
+	}
+
+	log.Printf("Disk %v is available on %v of the pi using disk %v\n", dsk.ID, diskMountPoint(dsk), root.ID)
+	return nil
+}
+
+//UnsurfaceDisk removes a data disk from the fstab of the pi that boots from root and releases the server side mount
+func (dm *diskManager) UnsurfaceDisk(root, dsk *disk) error {
+	err := dm.withDiskRoot(root, false, func(rootPath string) error {
+		return editFstab(rootPath, dsk, "")
+	})
+
+	key := surfaceKey(root, dsk)
+	dm.mountMutex.Lock()
+	wasSurfaced := dm.surfaced[key]
+	delete(dm.surfaced, key)
+	dm.mountMutex.Unlock()
+
+	if wasSurfaced {
+		unmountErr := dm.unmountDisk(dsk)
+		if err == nil {
+			err = unmountErr
+		}
+	}
+
+	return err
+}
+
+//forgetDisk forgets which pis a disk was surfaced to. Used when the disk is destroyed.
+func (dm *diskManager) forgetDisk(id string) {
+	dm.mountMutex.Lock()
+	defer dm.mountMutex.Unlock()
+
+	for key := range dm.surfaced {
+		if strings.HasPrefix(key, id+"@") {
+			delete(dm.surfaced, key)
+		}
+	}
+}
+
+//editFstab replaces the bakery entry for a disk in the fstab under rootPath and creates its mount point. An empty entry removes it.
+//The root disk belongs to the pi, so the files are changed through an os.Root and a symlink can't point the write at the server.
+func editFstab(rootPath string, dsk *disk, entry string) error {
+	root, err := os.OpenRoot(rootPath)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	content, err := root.ReadFile("etc/fstab")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	marker := fstabMarker + dsk.ID
+	var lines []string
+	skipNext := false
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		if skipNext {
+			skipNext = false
+			continue
+		}
+		if line == marker {
+			skipNext = true //the entry follows the marker
+			continue
+		}
+		if line != "" || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	if entry != "" {
+		lines = append(lines, marker, entry)
+
+		err = root.MkdirAll(strings.TrimPrefix(diskMountPoint(dsk), "/"), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = root.MkdirAll("etc", 0755)
+	if err != nil {
+		return err
+	}
+
+	return root.WriteFile("etc/fstab", []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
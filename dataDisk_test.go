@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEditFstab(t *testing.T) {
+	root := t.TempDir()
+	dsk := &disk{ID: "data1"}
+
+	err := editFstab(root, dsk, "server:/data1 /mnt/disks/data1 nfs defaults 0 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(root, "mnt/disks/data1")); err != nil {
+		t.Errorf("mount point was not created: %v", err)
+	}
+	fstab, _ := ioutil.ReadFile(path.Join(root, "etc/fstab"))
+	if !strings.Contains(string(fstab), fstabMarker+"data1\nserver:/data1") {
+		t.Errorf("fstab is %q", fstab)
+	}
+
+	err = editFstab(root, dsk, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fstab, _ = ioutil.ReadFile(path.Join(root, "etc/fstab"))
+	if strings.Contains(string(fstab), "data1") {
+		t.Errorf("entry was not removed: %q", fstab)
+	}
+}
+
+func TestEditFstabRefusesSymlinksOutOfTheDisk(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	//the pi replaced its /etc with a link to the server's
+	err := os.Symlink(outside, path.Join(root, "etc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = editFstab(root, &disk{ID: "data1"}, "server:/data1 /mnt/disks/data1 nfs defaults 0 0")
+	if err == nil {
+		t.Error("the fstab was written through a symlink out of the disk")
+	}
+	if _, err := os.Stat(path.Join(outside, "fstab")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside the disk: %v", err)
+	}
+}
@@ -1,50 +1,157 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
-	"strings"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type diskManager struct {
-	Disks map[string]*disk `json:"disks"`
-	fb    fileBackend
+	Disks           map[string]*disk `json:"disks"`
+	Orphans         []string         `json:"orphans,omitempty"` //folders in the NFS root that are not a disk
+	store           inventoryStore
+	fb              fileBackend
+	snapshotRoot    string
+	defaultRootMode diskMode
+	blockRootSize   int
+	nbd             *nbdServer
+	nbdPort         string
+	mountMutex      *sync.Mutex
+	mounts          map[string]*diskMount
+	exportRefs      map[string]int      //open NBD exports per disk
+	exportClients   map[string][]string //addresses each disk is exported to, keyed by disk id
+	exclusive       map[string]bool     //block disks whose disk.img is being copied or resized
+	surfaced        map[string]bool
+	disksMutex      *sync.RWMutex
 }
 
 type disk struct {
-	ID         string `json:"id"`
-	Location   string `json:"location"`
-	Size       int64  `json:"size"`
-	NfsAddress string `json:"nfsAddress"`
+	ID         string    `json:"id"`
+	Location   string    `json:"location"`
+	Size       int64     `json:"size"`
+	NfsAddress string    `json:"nfsAddress"`
+	Mode       diskMode  `json:"mode"`
+	FsType     string    `json:"fsType,omitempty"`
+	Used       int64     `json:"used"`            //space taken on the server in MB, 0 until it is first measured
+	UsedAt     time.Time `json:"usedAt,omitzero"` //when Used was measured
+	Quota      int64     `json:"quota,omitempty"` //limit in MB enforced with a project quota
+
+	CreatedAt      time.Time `json:"createdAt"`
+	SourceBakeform string    `json:"sourceBakeform,omitempty"`
+	Owner          string    `json:"owner,omitempty"`
+	Missing        bool      `json:"missing,omitempty"` //the disk is in the inventory but its folder is gone
 }
 
-func NewDiskManager(fb fileBackend) (*diskManager, error) {
+//NewDiskManager creates a disk manager. Root disks are created in defaultRootMode unless a bake asks otherwise,
+//block mode root disks are blockRootSize MB. Snapshots of disks are kept in snapshotRoot.
+func NewDiskManager(store inventoryStore, fb fileBackend, snapshotRoot, defaultRootMode string, blockRootSize int) (*diskManager, error) {
+	mode, err := parseDiskMode(defaultRootMode)
+	if err != nil {
+		return nil, err
+	}
+
 	dm := &diskManager{
-		Disks: make(map[string]*disk),
-		fb:    fb,
+		Disks:           make(map[string]*disk),
+		store:           store,
+		fb:              fb,
+		snapshotRoot:    snapshotRoot,
+		defaultRootMode: mode,
+		blockRootSize:   blockRootSize,
+		mountMutex:      &sync.Mutex{},
+		mounts:          make(map[string]*diskMount),
+		exportRefs:      make(map[string]int),
+		exportClients:   make(map[string][]string),
+		exclusive:       make(map[string]bool),
+		surfaced:        make(map[string]bool),
+		disksMutex:      &sync.RWMutex{},
+	}
+
+	err = dm.loadDisks()
+	if err != nil {
+		return nil, err
 	}
 
-	diskFolders := fb.GetNfsFolders("*")
-	for _, diskFolder := range diskFolders {
-		nameParts := strings.Split(diskFolder, "/")
-		id := nameParts[len(nameParts)-1]
+	return dm, nil
+}
+
+//loadDisks reads the disks from the inventory and checks them against the folders in the NFS root.
+//Disks without a folder are flagged missing, folders without a disk are reported as orphans and left alone.
+func (dm *diskManager) loadDisks() error {
+	records, err := dm.store.ListDisks()
+	if err != nil {
+		return err
+	}
 
-		dm.Disks[id] = &disk{
-			ID:         id,
-			Location:   diskFolder,
-			Size:       dm.getDiskSize(diskFolder),
-			NfsAddress: fb.GetNfsAddress(),
+	for _, record := range records {
+		dm.Disks[record.Id] = dm.diskFromRecord(record)
+	}
+
+	//inventories of older versions of bakery have no disks yet, every folder used to be a disk. Later strays are never adopted.
+	adopt, err := dm.store.PendingTask(taskAdoptDiskFolders)
+	if err != nil {
+		return err
+	}
+
+	for _, diskFolder := range dm.fb.GetNfsFolders("*") {
+		id := path.Base(diskFolder)
+		if _, exists := dm.Disks[id]; exists {
+			continue
+		}
+
+		if adopt {
+			log.Printf("Adding existing folder %v to the inventory as disk %v\n", diskFolder, id)
+			_, err = dm.RegisterDisk(context.Background(), id, diskFolder, "", "")
+			if err != nil {
+				return err
+			}
+			continue
 		}
+
+		log.Printf("Folder %v is not a disk in the inventory\n", diskFolder)
+		dm.Orphans = append(dm.Orphans, diskFolder)
 	}
 
-	return dm, nil
+	if adopt {
+		return dm.store.FinishTask(taskAdoptDiskFolders)
+	}
+
+	return nil
+}
+
+//diskFromRecord checks a disk of the inventory against its folder. A disk without a folder is flagged missing.
+func (dm *diskManager) diskFromRecord(record diskRecord) *disk {
+	var dsk *disk
+	if _, err := os.Stat(record.Location); os.IsNotExist(err) {
+		log.Printf("Disk %v is missing, %v does not exist\n", record.Id, record.Location)
+		dsk = &disk{
+			ID:         record.Id,
+			Location:   record.Location,
+			NfsAddress: dm.fb.GetNfsAddress(),
+			Missing:    true,
+		}
+	} else {
+		dsk = dm.probeDisk(record.Id, record.Location)
+	}
+
+	dsk.CreatedAt = record.CreatedAt
+	dsk.SourceBakeform = record.SourceBakeform
+	dsk.Owner = record.Owner
+	dsk.Quota = record.Quota
+	return dsk
 }
 
 func (dm *diskManager) getDiskSize(location string) int64 {
@@ -60,76 +167,307 @@ func (dm *diskManager) getDiskSize(location string) int64 {
 	return size
 }
 
-func (dm *diskManager) RegisterDisk(id, location string) *disk {
-	dm.Disks[id] = &disk{
+//probeDisk looks at the contents of a disk folder. Folders with a disk.img are block disks, all others are shared as is over NFS.
+func (dm *diskManager) probeDisk(id, location string) *disk {
+	mode := nfsDisk
+	fsType := ""
+	if _, err := os.Stat(path.Join(location, "disk.img")); err == nil {
+		mode = blockDisk
+		fsType = detectFsType(path.Join(location, "disk.img"))
+	}
+
+	return &disk{
 		ID:         id,
 		Location:   location,
 		Size:       dm.getDiskSize(location),
 		NfsAddress: dm.fb.GetNfsAddress(),
+		Mode:       mode,
+		FsType:     fsType,
+	}
+}
+
+//RegisterDisk adds a new disk folder to the inventory
+func (dm *diskManager) RegisterDisk(ctx context.Context, id, location, sourceBakeform, owner string) (*disk, error) {
+	dsk := dm.probeDisk(id, location)
+	dsk.CreatedAt = time.Now().UTC()
+	dsk.SourceBakeform = sourceBakeform
+	dsk.Owner = owner
+
+	err := dm.saveDisk(ctx, dsk)
+	if err != nil {
+		return nil, err
 	}
 
-	return dm.Disks[id]
+	dm.disksMutex.Lock()
+	dm.Disks[id] = dsk
+	dm.disksMutex.Unlock()
+
+	return dsk, nil
+}
+
+//saveDisk stores the metadata of a disk in the inventory
+func (dm *diskManager) saveDisk(ctx context.Context, dsk *disk) error {
+	_, span := startSpan(ctx, "store.saveDisk", attribute.String("bakery.disk_id", dsk.ID))
+	err := dm.store.SaveDisk(diskRecord{
+		Id:             dsk.ID,
+		Location:       dsk.Location,
+		CreatedAt:      dsk.CreatedAt,
+		SourceBakeform: dsk.SourceBakeform,
+		Owner:          dsk.Owner,
+		Quota:          dsk.Quota,
+	})
+	endSpan(span, err)
+	return err
 }
 
-func (dm *diskManager) NewDisk(size int) (*disk, error) {
+//GetDisk returns the disk with the given id.
+//Disks is a cache of the inventory, a disk another bakery sharing the inventory created is read from the inventory.
+func (dm *diskManager) GetDisk(id string) (*disk, bool) {
+	dm.disksMutex.RLock()
+	dsk, exists := dm.Disks[id]
+	dm.disksMutex.RUnlock()
+	if exists {
+		return dsk, true
+	}
+
+	record, err := dm.store.GetDisk(id)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Unable to read disk %v from the inventory: %v\n", id, err)
+		}
+		return nil, false
+	}
+
+	return dm.cacheDisk(record), true
+}
+
+//ListDisks returns all disks in the inventory
+func (dm *diskManager) ListDisks() []*disk {
+	records, err := dm.store.ListDisks()
+	if err != nil {
+		log.Printf("Unable to list disks in the inventory, listing known disks: %v\n", err)
+		dm.disksMutex.RLock()
+		defer dm.disksMutex.RUnlock()
+
+		disks := make([]*disk, 0, len(dm.Disks))
+		for _, dsk := range dm.Disks {
+			disks = append(disks, dsk)
+		}
+		return disks
+	}
+
+	disks := make([]*disk, 0, len(records))
+	for _, record := range records {
+		disks = append(disks, dm.cacheDisk(record))
+	}
+	return disks
+}
+
+//cacheDisk returns the cached disk of a record, it is added to the cache if it is not known yet
+func (dm *diskManager) cacheDisk(record diskRecord) *disk {
+	dm.disksMutex.RLock()
+	dsk, exists := dm.Disks[record.Id]
+	dm.disksMutex.RUnlock()
+	if exists {
+		return dsk
+	}
+
+	dsk = dm.diskFromRecord(record)
+
+	dm.disksMutex.Lock()
+	defer dm.disksMutex.Unlock()
+	if cached, exists := dm.Disks[record.Id]; exists {
+		return cached
+	}
+	dm.Disks[record.Id] = dsk
+	return dsk
+}
+
+//NewDisk creates a block disk of size MB, formatted with fsType (ext4 or xfs)
+func (dm *diskManager) NewDisk(ctx context.Context, size int, fsType, owner string) (*disk, error) {
 	if size <= 0 {
 		return nil, fmt.Errorf("Disk size should be larger than 0")
 	}
 
+	if fsType == "" {
+		fsType = "ext4"
+	}
+	if fsType != "ext4" && fsType != "xfs" {
+		return nil, fmt.Errorf("Unsupported filesystem %v", fsType)
+	}
+
 	id := uuid.New().String()
 
 	log.Printf("Creating new disk with id: %v", id)
-	location, err := dm.fb.CreateNfsFolder(id)
+	location, err := dm.fb.CreateNfsFolder(ctx, id)
 	if err != nil {
 		return &disk{}, err
 	}
 
 	//Create disk file
 	sizeInBytes := int64(size * 1024 * 1024)
-	fd, err := os.Create(path.Join(location, "disk.img"))
-	defer fd.Close()
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create disk")
+	img := path.Join(location, "disk.img")
+	err = createSparseFile(img, sizeInBytes)
+	if err == nil {
+		err = formatDisk(img, fsType)
 	}
-
-	fd.Seek(sizeInBytes-1, 0)
-	_, err = fd.Write([]byte{0})
 	if err != nil {
-		return nil, fmt.Errorf("Write failed")
+		dm.fb.DeleteNfsFolder(ctx, id)
+		return nil, err
 	}
 
-	return dm.RegisterDisk(id, location), nil
+	return dm.RegisterDisk(ctx, id, location, "", owner)
 }
 
-func (dm *diskManager) DiskFromBakeform(bf *Bakeform) (*disk, error) {
-	err := bf.mount()
+//DiskFromBakeform clones the root partition of a bakeform into a new disk. An empty mode creates a disk in the default root mode.
+func (dm *diskManager) DiskFromBakeform(ctx context.Context, bf *Bakeform, mode diskMode) (*disk, error) {
+	if mode == "" {
+		mode = dm.defaultRootMode
+	}
+
+	err := bf.mount(ctx)
 	if err != nil {
 		return &disk{}, err
 	}
 
 	id := uuid.New().String()
 
-	log.Printf("Creating new disk with id %v from bakeform %v", id, bf.Name)
-	location, err := dm.fb.CopyNfsFolder(bf.MountedOn[1]+"/", id)
+	loggerFrom(ctx).Info("Creating disk from bakeform", "diskId", id, "mode", mode, "bakeform", bf.Name)
+	if mode == blockDisk {
+		return dm.blockDiskFromFolder(ctx, id, bf.MountedOn[1]+"/", bf.Name)
+	}
+
+	location, err := dm.fb.CopyNfsFolder(ctx, bf.MountedOn[1]+"/", id)
 	if err != nil {
 		return &disk{}, err
 	}
 
-	return dm.RegisterDisk(id, location), nil
+	return dm.RegisterDisk(ctx, id, location, bf.Name, "")
+}
+
+//CloneDisk creates a new disk with a copy of the contents of an existing disk. Block disks that are in use by a pi can't be cloned,
+//copying a disk.img that is being written gives a torn image. Clones of root disks get their own identity.
+func (dm *diskManager) CloneDisk(ctx context.Context, id string) (*disk, error) {
+	dsk, exists := dm.GetDisk(id)
+	if !exists {
+		return nil, fmt.Errorf("Disk with id %v not found", id)
+	}
+
+	if dsk.Mode == blockDisk {
+		err := dm.lockExclusive(id)
+		if err != nil {
+			return nil, err
+		}
+		defer dm.unlockExclusive(id)
+	}
+
+	newId := uuid.New().String()
+
+	loggerFrom(ctx).Info("Cloning disk", "diskId", id, "cloneId", newId)
+	location, err := dm.fb.CreateNfsFolder(ctx, newId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = copyDiskContents(dsk, dsk.Location, location)
+	if err != nil {
+		dm.fb.DeleteNfsFolder(ctx, newId)
+		return nil, err
+	}
+
+	clone, err := dm.RegisterDisk(ctx, newId, location, dsk.SourceBakeform, dsk.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	//disks made from a bakeform are root disks
+	if clone.SourceBakeform != "" {
+		err = dm.withDiskRoot(clone, false, func(root string) error {
+			return personaliseDisk(root, "clone-"+newId[:8])
+		})
+		if err != nil {
+			dm.DestroyDisk(ctx, newId)
+			return nil, err
+		}
+	}
+
+	return clone, nil
+}
+
+//ExportTo restricts the NFS and NBD exports of each disk to the given client addresses, keyed by disk id
+func (dm *diskManager) ExportTo(ctx context.Context, clients map[string][]string) error {
+	dm.mountMutex.Lock()
+	previous := dm.exportClients
+	dm.exportClients = clients
+	dm.mountMutex.Unlock()
+
+	//a pi that lost a block disk must not keep using it through a connection it opened before
+	if dm.nbd != nil {
+		for id, addresses := range previous {
+			if !slices.Equal(addresses, clients[id]) {
+				dm.nbd.Disconnect(id)
+			}
+		}
+	}
+
+	return dm.fb.SetExportClients(ctx, clients)
 }
 
-func (dm *diskManager) DestroyDisk(id string) error {
-	//TODO check if realy destroying a diks, not something else.... check if id == uuid fe
+func (dm *diskManager) DestroyDisk(ctx context.Context, id string) error {
+	//only folders of disks in the inventory are removed, never anything else in the NFS root
+	dsk, exists := dm.GetDisk(id)
+	if !exists {
+		return fmt.Errorf("Disk with id %v not found", id)
+	}
+
+	if dm.nbd != nil {
+		dm.nbd.Disconnect(id)
+	}
+
+	if dsk.Mode == blockDisk {
+		dm.forgetDisk(id)
+		err := dm.releaseDisk(dsk)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, span := startSpan(ctx, "store.deleteDisk", attribute.String("bakery.disk_id", id))
+	err := dm.store.DeleteDisk(id)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	dm.disksMutex.Lock()
 	delete(dm.Disks, id)
-	return dm.fb.DeleteNfsFolder(id)
+	dm.disksMutex.Unlock()
+
+	err = dm.deleteSnapshots(id)
+	if err != nil {
+		loggerFrom(ctx).Error("Unable to delete snapshots of disk", "diskId", id, "error", err)
+	}
+
+	return dm.fb.DeleteNfsFolder(ctx, id)
 }
 
 func (dm *diskManager) PutFileOnDisk(diskId, filePath string, content []byte) error {
-	disk, exists := dm.Disks[diskId]
+	disk, exists := dm.GetDisk(diskId)
 	if !exists {
 		return fmt.Errorf("Disk with id %v not found", diskId)
 	}
 
+	if disk.Mode == blockDisk {
+		return dm.withDiskRoot(disk, false, func(root string) error {
+			fullFilePath := path.Join(root, filePath)
+			err := os.MkdirAll(path.Dir(fullFilePath), 0755)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(fullFilePath, content, 0666)
+		})
+	}
+
 	file := path.Join(disk.ID, filePath)
 	dm.fb.PutFileInNfsFolder(file, content)
 
@@ -137,18 +475,30 @@ func (dm *diskManager) PutFileOnDisk(diskId, filePath string, content []byte) er
 }
 
 func (dm *diskManager) GetFileFromDisk(diskId, filePath string) ([]byte, error) {
-	disk, exists := dm.Disks[diskId]
+	disk, exists := dm.GetDisk(diskId)
 	if !exists {
 		return nil, fmt.Errorf("Disk with id %v not found", diskId)
 	}
 
+	if disk.Mode == blockDisk {
+		var content []byte
+		err := dm.withDiskRoot(disk, true, func(root string) error {
+			var err error
+			content, err = ioutil.ReadFile(path.Join(root, filePath))
+			return err
+		})
+		return content, err
+	}
+
 	file := path.Join(disk.ID, filePath)
 	return dm.fb.GetFileFromNfsFolder(file)
 }
 
 func (dm *diskManager) createDiskHandler(w http.ResponseWriter, r *http.Request) {
 	var params struct {
-		Size int `json:"size"`
+		Size   int    `json:"size"`
+		FsType string `json:"fsType"`
+		Owner  string `json:"owner"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&params)
@@ -157,12 +507,13 @@ func (dm *diskManager) createDiskHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	disk, err := dm.NewDisk(params.Size)
+	disk, err := dm.NewDisk(r.Context(), params.Size, params.FsType, params.Owner)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write(([]byte(err.Error())))
 		return
 	}
+	setAuditTarget(r, disk.ID)
 
 	jsonBytes, err := json.Marshal(disk)
 	if err != nil {
@@ -175,6 +526,78 @@ func (dm *diskManager) createDiskHandler(w http.ResponseWriter, r *http.Request)
 	w.Write(jsonBytes)
 }
 
+func (dm *diskManager) cloneDiskHandler(w http.ResponseWriter, r *http.Request) {
+	diskId := mux.Vars(r)["diskId"]
+	if _, exists := dm.GetDisk(diskId); !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	disk, err := dm.CloneDisk(r.Context(), diskId)
+	if errors.Is(err, errDiskInUse) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write(([]byte(err.Error())))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(([]byte(err.Error())))
+		return
+	}
+
+	jsonBytes, err := json.Marshal(disk)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(([]byte(err.Error())))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+}
+
+func (dm *diskManager) resizeDiskHandler(w http.ResponseWriter, r *http.Request) {
+	diskId := mux.Vars(r)["diskId"]
+
+	var params struct {
+		Size int `json:"size"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, exists := dm.GetDisk(diskId); !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = dm.ResizeDisk(diskId, params.Size)
+	if errors.Is(err, errDiskInUse) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write(([]byte(err.Error())))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(([]byte(err.Error())))
+		return
+	}
+
+	dsk, _ := dm.GetDisk(diskId)
+	dm.disksMutex.RLock()
+	jsonBytes, err := json.Marshal(dsk)
+	dm.disksMutex.RUnlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
+
 func (dm *diskManager) destroyDiskHandler(w http.ResponseWriter, r *http.Request) {
 	diskId := mux.Vars(r)["diskId"]
 	if diskId == "" {
@@ -182,7 +605,12 @@ func (dm *diskManager) destroyDiskHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err := dm.DestroyDisk(diskId)
+	if _, exists := dm.GetDisk(diskId); !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := dm.DestroyDisk(r.Context(), diskId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write(([]byte(err.Error())))
@@ -193,7 +621,9 @@ func (dm *diskManager) destroyDiskHandler(w http.ResponseWriter, r *http.Request
 }
 
 func (dm *diskManager) listDisksHandler(w http.ResponseWriter, r *http.Request) {
+	dm.disksMutex.RLock()
 	jsonBytes, err := json.Marshal(dm)
+	dm.disksMutex.RUnlock()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -209,7 +639,7 @@ func (dm *diskManager) getDiskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	disk, exists := dm.Disks[diskId]
+	disk, exists := dm.GetDisk(diskId)
 	if !exists {
 		w.WriteHeader(http.StatusNotFound)
 		return
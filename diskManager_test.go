@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAdoptDiskFoldersOnce(t *testing.T) {
+	dir := t.TempDir()
+	nfsRoot := path.Join(dir, "nfs")
+	err := os.MkdirAll(path.Join(nfsRoot, "legacy"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openInventory(path.Join(dir, "inventory.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := newFileBackend("127.0.0.1", nfsRoot, path.Join(dir, "boot"), "3", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the first start after the migration adopts the folders bakery used to treat as disks
+	dm, err := NewDiskManager(store, fb, path.Join(dir, "snapshots"), "nfs", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := dm.GetDisk("legacy"); !exists {
+		t.Fatal("the folder of an older inventory was not adopted")
+	}
+
+	//with every disk deleted, folders that show up later are strays
+	err = store.DeleteDisk("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(path.Join(nfsRoot, "stray"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dm, err = NewDiskManager(store, fb, path.Join(dir, "snapshots"), "nfs", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dm.ListDisks()) != 0 {
+		t.Errorf("folders were adopted again: %v", dm.ListDisks())
+	}
+	if len(dm.Orphans) != 2 {
+		t.Errorf("orphans are %v, want the two folders", dm.Orphans)
+	}
+}
+
+func TestDisksOfOtherBakeries(t *testing.T) {
+	dir := t.TempDir()
+	nfsRoot := path.Join(dir, "nfs")
+	store, err := openInventory(path.Join(dir, "inventory.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := newFileBackend("127.0.0.1", nfsRoot, path.Join(dir, "boot"), "3", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//two bakeries share the inventory and the NFS root
+	a, err := NewDiskManager(store, fb, path.Join(dir, "snapshots"), "nfs", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewDiskManager(store, fb, path.Join(dir, "snapshots"), "nfs", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(path.Join(nfsRoot, "data1"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.RegisterDisk(context.Background(), "data1", path.Join(nfsRoot, "data1"), "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsk, exists := b.GetDisk("data1")
+	if !exists || dsk.Owner != "alice" {
+		t.Errorf("the other bakery does not see the disk: %+v", dsk)
+	}
+	if len(b.ListDisks()) != 1 {
+		t.Errorf("the other bakery lists %v", b.ListDisks())
+	}
+	if _, exists := b.GetDisk("data2"); exists {
+		t.Error("a disk that is in no inventory exists")
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+//Snapshots live in {snapshotRoot}/{diskId}/{snapshotId}. The contents of NFS disks are copied to data/, block disks keep a sparse copy of disk.img.
+
+type snapshot struct {
+	ID      string    `json:"id"`
+	DiskID  string    `json:"diskId"`
+	Created time.Time `json:"created"`
+	Used    int64     `json:"used"`
+}
+
+func (dm *diskManager) snapshotFolder(diskId, snapshotId string) string {
+	return path.Join(dm.snapshotRoot, diskId, snapshotId)
+}
+
+//copyDiskContents copies the contents of a disk from one folder to another, keeping ownership, hard links and sparse files
+func copyDiskContents(dsk *disk, source, dest string) error {
+	var cmd *exec.Cmd
+	if dsk.Mode == blockDisk {
+		cmd = exec.Command("cp", "--sparse=always", "--reflink=auto", path.Join(source, "disk.img"), path.Join(dest, "disk.img"))
+	} else {
+		cmd = exec.Command("rsync", "-aHAXSx", "--numeric-ids", "--delete", source+"/", dest+"/")
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to copy disk %v: %v %v", dsk.ID, err, string(out))
+	}
+
+	return nil
+}
+
+//CreateSnapshot copies the current contents of a disk.
+//A block disk a pi is using over NBD can't be snapshotted, one that is mounted on the server is frozen while it is copied.
+//NFS disks are copied file by file, if a pi writes to one during the copy the files in the snapshot may not match each other.
+func (dm *diskManager) CreateSnapshot(diskId string) (*snapshot, error) {
+	dsk, exists := dm.GetDisk(diskId)
+	if !exists {
+		return nil, fmt.Errorf("Disk with id %v not found", diskId)
+	}
+
+	if dsk.Mode == blockDisk {
+		err := dm.lockExclusive(diskId)
+		if err != nil {
+			return nil, err
+		}
+		defer dm.unlockExclusive(diskId)
+
+		thaw, err := dm.freezeDisk(dsk)
+		if err != nil {
+			return nil, err
+		}
+		defer thaw()
+	}
+
+	snap := &snapshot{
+		ID:      uuid.New().String(),
+		DiskID:  diskId,
+		Created: time.Now().UTC(),
+	}
+
+	folder := dm.snapshotFolder(diskId, snap.ID)
+	dataFolder := folder
+	if dsk.Mode != blockDisk {
+		dataFolder = path.Join(folder, "data")
+	}
+
+	err := os.MkdirAll(dataFolder, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Creating snapshot %v of disk %v\n", snap.ID, diskId)
+	err = copyDiskContents(dsk, dsk.Location, dataFolder)
+	if err != nil {
+		os.RemoveAll(folder)
+		return nil, err
+	}
+	snap.Used = diskUsage(folder)
+
+	meta, err := json.Marshal(snap)
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(folder, "snapshot.json"), meta, 0600)
+	}
+	if err != nil {
+		os.RemoveAll(folder)
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+//ListSnapshots returns the snapshots of a disk, oldest first
+func (dm *diskManager) ListSnapshots(diskId string) ([]*snapshot, error) {
+	snapshots := []*snapshot{}
+
+	folders, err := ioutil.ReadDir(path.Join(dm.snapshotRoot, diskId))
+	if os.IsNotExist(err) {
+		return snapshots, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, folder := range folders {
+		snap, err := dm.GetSnapshot(diskId, folder.Name())
+		if err != nil {
+			log.Printf("Skipping snapshot %v of disk %v: %v\n", folder.Name(), diskId, err)
+			continue
+		}
+		snapshots = append(snapshots, snap)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+
+	return snapshots, nil
+}
+
+func (dm *diskManager) GetSnapshot(diskId, snapshotId string) (*snapshot, error) {
+	if snapshotId == "" || strings.ContainsAny(snapshotId, "/.") {
+		return nil, fmt.Errorf("Snapshot with id %v not found", snapshotId)
+	}
+
+	meta, err := ioutil.ReadFile(path.Join(dm.snapshotFolder(diskId, snapshotId), "snapshot.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Snapshot with id %v not found", snapshotId)
+	}
+
+	var snap snapshot
+	err = json.Unmarshal(meta, &snap)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snap, nil
+}
+
+func (dm *diskManager) DeleteSnapshot(diskId, snapshotId string) error {
+	_, err := dm.GetSnapshot(diskId, snapshotId)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dm.snapshotFolder(diskId, snapshotId))
+}
+
+//deleteSnapshots removes all snapshots of a disk. Used when the disk is destroyed.
+func (dm *diskManager) deleteSnapshots(diskId string) error {
+	return os.RemoveAll(path.Join(dm.snapshotRoot, diskId))
+}
+
+//RestoreSnapshot puts the contents of a snapshot back on its disk. Nothing should be using the disk while it is restored.
+func (dm *diskManager) RestoreSnapshot(diskId, snapshotId string) error {
+	dsk, exists := dm.GetDisk(diskId)
+	if !exists {
+		return fmt.Errorf("Disk with id %v not found", diskId)
+	}
+
+	_, err := dm.GetSnapshot(diskId, snapshotId)
+	if err != nil {
+		return err
+	}
+
+	folder := dm.snapshotFolder(diskId, snapshotId)
+	if dsk.Mode != blockDisk {
+		log.Printf("Restoring disk %v from snapshot %v\n", diskId, snapshotId)
+		return copyDiskContents(dsk, path.Join(folder, "data"), dsk.Location)
+	}
+
+	if dm.nbd != nil {
+		dm.nbd.Disconnect(diskId)
+	}
+
+	//pis can't connect while the image is swapped
+	err = dm.waitExclusive(diskId)
+	if err != nil {
+		return err
+	}
+	defer dm.unlockExclusive(diskId)
+
+	//data disks are mounted on the server while they are surfaced, swap the image underneath and mount it again
+	surfaced := dm.surfacedCount(diskId)
+	if surfaced > 0 {
+		err = dm.releaseDisk(dsk)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Restoring disk %v from snapshot %v\n", diskId, snapshotId)
+	err = copyDiskContents(dsk, folder, dsk.Location)
+
+	for i := 0; i < surfaced; i++ {
+		_, mountErr := dm.mountDisk(dsk, false)
+		if mountErr != nil && err == nil {
+			err = mountErr
+		}
+	}
+
+	return err
+}
+
+//waitExclusive reserves a block disk whose NBD clients were just disconnected. Their connections take a moment to close.
+func (dm *diskManager) waitExclusive(id string) error {
+	var err error
+	for i := 0; i < 50; i++ {
+		err = dm.lockExclusive(id)
+		if !errors.Is(err, errDiskInUse) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+//freezeDisk stops writes to a block disk that is mounted read write on the server until thaw is called
+func (dm *diskManager) freezeDisk(dsk *disk) (thaw func(), err error) {
+	dm.mountMutex.Lock()
+	m, mounted := dm.mounts[dsk.ID]
+	frozen := mounted && !m.readOnly
+	dm.mountMutex.Unlock()
+
+	if !frozen {
+		return func() {}, nil
+	}
+
+	mountPoint := path.Join(dsk.Location, "mnt")
+	out, err := exec.Command("fsfreeze", "-f", mountPoint).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to freeze disk %v: %v %v", dsk.ID, err, string(out))
+	}
+
+	return func() {
+		out, err := exec.Command("fsfreeze", "-u", mountPoint).CombinedOutput()
+		if err != nil {
+			log.Printf("Unable to thaw disk %v: %v %v\n", dsk.ID, err, string(out))
+		}
+	}, nil
+}
+
+//surfacedCount returns the number of pis a disk is surfaced to
+func (dm *diskManager) surfacedCount(id string) int {
+	dm.mountMutex.Lock()
+	defer dm.mountMutex.Unlock()
+
+	count := 0
+	for key := range dm.surfaced {
+		if strings.HasPrefix(key, id+"@") {
+			count++
+		}
+	}
+	return count
+}
+
+func (dm *diskManager) createSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	diskId := mux.Vars(r)["diskId"]
+	if _, exists := dm.GetDisk(diskId); !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	snap, err := dm.CreateSnapshot(diskId)
+	if errors.Is(err, errDiskInUse) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write(([]byte(err.Error())))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(([]byte(err.Error())))
+		return
+	}
+
+	jsonBytes, err := json.Marshal(snap)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+}
+
+func (dm *diskManager) listSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	diskId := mux.Vars(r)["diskId"]
+	if _, exists := dm.GetDisk(diskId); !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	snapshots, err := dm.ListSnapshots(diskId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(([]byte(err.Error())))
+		return
+	}
+
+	jsonBytes, err := json.Marshal(snapshots)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
+
+func (dm *diskManager) deleteSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	err := dm.DeleteSnapshot(params["diskId"], params["snapshotId"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(([]byte(err.Error())))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+//RestoreSnapshotHandler restores a disk from a snapshot. Pis using the disk are powered off for the duration of the restore.
+func (pm *PiManager) RestoreSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	diskId := params["diskId"]
+	snapshotId := params["snapshotId"]
+
+	if _, exists := pm.diskManager.GetDisk(diskId); !exists {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Disk not found"))
+		return
+	}
+
+	_, err := pm.diskManager.GetSnapshot(diskId, snapshotId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	pis, err := pm.ListOven()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var users []PiInfo
+	for _, pi := range pis {
+		for _, dsk := range pi.Disks {
+			if dsk != nil && dsk.ID == diskId {
+				users = append(users, pi)
+				break
+			}
+		}
+	}
+
+	for i, pi := range users {
+		err = pi.PowerOff(r.Context())
+		if err != nil {
+			//the disk is left as it is, the pis that were already powered off go back to running on it
+			powerOnPis(r.Context(), users[:i], diskId)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("Unable to power off pi %v: %v", pi.Id, err)))
+			return
+		}
+	}
+
+	restoreErr := pm.diskManager.RestoreSnapshot(diskId, snapshotId)
+	if restoreErr != nil {
+		log.Printf("Unable to restore disk %v from snapshot %v: %v\n", diskId, snapshotId, restoreErr)
+	}
+
+	//power the pis back on even if the restore failed, they were running before
+	powerOnPis(r.Context(), users, diskId)
+
+	if restoreErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(restoreErr.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+//powerOnPis powers on the pis that were powered off to restore a disk
+func powerOnPis(ctx context.Context, pis []PiInfo, diskId string) {
+	for _, pi := range pis {
+		err := pi.PowerOn(ctx)
+		if err != nil {
+			log.Printf("Unable to power on pi %v after restoring disk %v: %v\n", pi.Id, diskId, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSnapshotOfBlockDiskInUse(t *testing.T) {
+	dm, address := startTestNbdServer(t)
+
+	conn, _, err := connectTestNbd(t, address, "disk1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//copying disk.img while the pi writes to it gives a torn image
+	_, err = dm.CreateSnapshot("disk1")
+	if !errors.Is(err, errDiskInUse) {
+		t.Fatalf("snapshot of a disk in use: %v", err)
+	}
+
+	conn.Close()
+	for i := 0; i < 50 && dm.nbdInUse("disk1"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	snap, err := dm.CreateSnapshot("disk1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a restore disconnects the pi and keeps it out until the image is back
+	_, _, err = connectTestNbd(t, address, "disk1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.RestoreSnapshot("disk1", snap.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dm.nbdInUse("disk1") {
+		t.Error("the disconnected pi still uses the disk")
+	}
+}
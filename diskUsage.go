@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//diskUsage returns the space a disk folder takes on the server in MB, like du -sx.
+//Hard links are counted once and sparse files only count the blocks they use.
+func diskUsage(location string) int64 {
+	var root syscall.Stat_t
+	err := syscall.Lstat(location, &root)
+	if err != nil {
+		return 0
+	}
+
+	var blocks int64
+	seen := make(map[uint64]bool)
+	filepath.Walk(location, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil //files can disappear while a pi is running
+		}
+
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+
+		//don't descend into the loop mounts of block disks
+		if st.Dev != root.Dev {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if st.Nlink > 1 {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+
+		blocks += st.Blocks
+		return nil
+	})
+
+	return blocks * 512 / 1024 / 1024
+}
+
+//RefreshUsage recalculates the usage of every disk
+func (dm *diskManager) RefreshUsage() {
+	for _, dsk := range dm.ListDisks() {
+		used := diskUsage(dsk.Location)
+
+		dm.disksMutex.Lock()
+		dsk.Used = used
+		dsk.UsedAt = time.Now().UTC()
+		dm.disksMutex.Unlock()
+	}
+}
+
+//WatchUsage keeps the usage of the disks up to date. Walking a root disk is expensive, so it is only done here, every interval,
+//and never while starting up or registering a disk. Until then disks report the usage of the last walk, or 0 for new disks.
+func (dm *diskManager) WatchUsage(interval time.Duration) {
+	for {
+		dm.RefreshUsage()
+		time.Sleep(interval)
+	}
+}
+
+//projectId derives the quota project of a disk from its id
+func projectId(diskId string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(diskId))
+	return h.Sum32()&0x7fffffff | 1
+}
+
+//SetQuota limits the space an NFS disk can use to quota MB, 0 removes the limit.
+//The filesystem holding the NFS root needs project quotas enabled (prjquota mount option).
+func (dm *diskManager) SetQuota(ctx context.Context, id string, quota int64) error {
+	dsk, exists := dm.GetDisk(id)
+	if !exists {
+		return fmt.Errorf("Disk with id %v not found", id)
+	}
+
+	if dsk.Mode == blockDisk {
+		return fmt.Errorf("Disk with id %v is a block disk, its size is its limit", id)
+	}
+	if quota < 0 {
+		return fmt.Errorf("Quota should not be negative")
+	}
+
+	out, err := exec.Command("findmnt", "-n", "-o", "TARGET,FSTYPE", "-T", dsk.Location).Output()
+	if err != nil {
+		return fmt.Errorf("Unable to find the filesystem of disk %v: %v", id, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return fmt.Errorf("Unable to find the filesystem of disk %v", id)
+	}
+	mountPoint, fsType := fields[0], fields[1]
+
+	project := fmt.Sprint(projectId(id))
+	var cmds [][]string
+	switch fsType {
+	case "xfs":
+		cmds = [][]string{
+			{"xfs_quota", "-x", "-c", fmt.Sprintf("project -s -p %v %v", dsk.Location, project), mountPoint},
+			{"xfs_quota", "-x", "-c", fmt.Sprintf("limit -p bhard=%vm %v", quota, project), mountPoint},
+		}
+	case "ext4":
+		cmds = [][]string{
+			{"chattr", "-R", "-p", project, "+P", dsk.Location},
+			{"setquota", "-P", project, "0", fmt.Sprint(quota * 1024), "0", "0", mountPoint},
+		}
+	default:
+		return fmt.Errorf("Quotas are not supported on %v", fsType)
+	}
+
+	for _, cmd := range cmds {
+		out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Unable to set quota on disk %v: %v %v", id, err, string(out))
+		}
+	}
+
+	dm.disksMutex.Lock()
+	dsk.Quota = quota
+	dm.disksMutex.Unlock()
+
+	err = dm.saveDisk(ctx, dsk)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Quota of disk %v set to %v MB\n", id, quota)
+	return nil
+}
+
+func (dm *diskManager) setQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	diskId := mux.Vars(r)["diskId"]
+	if diskId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var params struct {
+		Quota int64 `json:"quota"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, exists := dm.GetDisk(diskId); !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = dm.SetQuota(r.Context(), diskId, params.Quota)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(([]byte(err.Error())))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	nfs "github.com/willscott/go-nfs"
+	nfshelper "github.com/willscott/go-nfs/helpers"
+)
+
+//embeddedNfsServer is a userspace NFSv3 server for the folders in the NFS root, so bakery does not need the kernel NFS server or root to share disks.
+//Clients mount a folder by its full path, the same way they would with the kernel server, and only get to see that folder.
+type embeddedNfsServer struct {
+	address string
+	fb      *FileBackend
+}
+
+//refusedMount is handed to go-nfs with a refused mount, it builds a root handle from the filesystem even when the mount fails
+var refusedMount = memfs.New()
+
+//nfsFolder adds the attribute changes NFS clients expect on top of an os backed billy filesystem.
+//File handles outlive a mount, so every call checks the folder is still exported to the client that mounted it.
+type nfsFolder struct {
+	billy.Filesystem
+	fb     *FileBackend
+	folder string
+	client string
+}
+
+func (f nfsFolder) check() error {
+	if !f.fb.exportedTo(f.folder, f.client) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (f nfsFolder) Create(filename string) (billy.File, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.Filesystem.Create(filename)
+}
+
+func (f nfsFolder) Open(filename string) (billy.File, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.Filesystem.Open(filename)
+}
+
+func (f nfsFolder) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.Filesystem.OpenFile(filename, flag, perm)
+}
+
+func (f nfsFolder) Stat(filename string) (os.FileInfo, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.Filesystem.Stat(filename)
+}
+
+func (f nfsFolder) Lstat(filename string) (os.FileInfo, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.Filesystem.Lstat(filename)
+}
+
+func (f nfsFolder) Rename(oldpath, newpath string) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.Filesystem.Rename(oldpath, newpath)
+}
+
+func (f nfsFolder) Remove(filename string) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.Filesystem.Remove(filename)
+}
+
+func (f nfsFolder) TempFile(dir, prefix string) (billy.File, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.Filesystem.TempFile(dir, prefix)
+}
+
+func (f nfsFolder) ReadDir(path string) ([]os.FileInfo, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.Filesystem.ReadDir(path)
+}
+
+func (f nfsFolder) MkdirAll(filename string, perm os.FileMode) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.Filesystem.MkdirAll(filename, perm)
+}
+
+func (f nfsFolder) Symlink(target, link string) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.Filesystem.Symlink(target, link)
+}
+
+func (f nfsFolder) Readlink(link string) (string, error) {
+	if err := f.check(); err != nil {
+		return "", err
+	}
+	return f.Filesystem.Readlink(link)
+}
+
+func (f nfsFolder) Chroot(path string) (billy.Filesystem, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	chrooted, err := f.Filesystem.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+	return nfsFolder{Filesystem: chrooted, fb: f.fb, folder: f.folder, client: f.client}, nil
+}
+
+//inRoot runs an attribute change on the folder opened as an os.Root. The pi owns everything in the folder,
+//a symlink it made must not point a change at a file of the server.
+func (f nfsFolder) inRoot(name string, change func(root *os.Root, name string) error) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+
+	root, err := os.OpenRoot(f.Root())
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		name = "."
+	}
+	return change(root, name)
+}
+
+func (f nfsFolder) Chmod(name string, mode os.FileMode) error {
+	return f.inRoot(name, func(root *os.Root, name string) error {
+		return root.Chmod(name, mode)
+	})
+}
+
+func (f nfsFolder) Lchown(name string, uid, gid int) error {
+	return f.inRoot(name, func(root *os.Root, name string) error {
+		return root.Lchown(name, uid, gid)
+	})
+}
+
+func (f nfsFolder) Chown(name string, uid, gid int) error {
+	return f.inRoot(name, func(root *os.Root, name string) error {
+		return root.Chown(name, uid, gid)
+	})
+}
+
+func (f nfsFolder) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return f.inRoot(name, func(root *os.Root, name string) error {
+		return root.Chtimes(name, atime, mtime)
+	})
+}
+
+func (s *embeddedNfsServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	log.Printf("Embedded NFS server listening on %v\n", listener.Addr())
+	return s.serve(listener)
+}
+
+func (s *embeddedNfsServer) serve(listener net.Listener) error {
+	//file handles are kept in memory, pis remount after a restart of bakery
+	return nfs.Serve(listener, nfshelper.NewCachingHandler(s, 1<<20))
+}
+
+//Mount resolves the requested path to a folder in the NFS root and checks the client is allowed to use it
+func (s *embeddedNfsServer) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	requested := path.Clean("/" + string(req.Dirpath))
+	relative := strings.TrimPrefix(requested, strings.TrimRight(s.fb.nfsRoot, "/"))
+	if relative == requested || relative == "" || relative == "/" {
+		log.Printf("Embedded NFS: %v tried to mount %v, which is not a bakery folder\n", conn.RemoteAddr(), requested)
+		return nfs.MountStatusErrAcces, refusedMount, nil
+	}
+
+	folder := strings.SplitN(strings.TrimPrefix(relative, "/"), "/", 2)[0]
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !s.fb.exportedTo(folder, clientIP) {
+		log.Printf("Embedded NFS: %v is not allowed to mount %v\n", clientIP, requested)
+		return nfs.MountStatusErrAcces, refusedMount, nil
+	}
+
+	fi, err := os.Stat(requested)
+	if os.IsNotExist(err) {
+		return nfs.MountStatusErrNoEnt, refusedMount, nil
+	}
+	if err != nil {
+		return nfs.MountStatusErrIO, refusedMount, nil
+	}
+	if !fi.IsDir() {
+		return nfs.MountStatusErrNotDir, refusedMount, nil
+	}
+
+	//a bound filesystem keeps absolute symlinks in the pi's root from escaping the folder
+	return nfs.MountStatusOk, nfsFolder{Filesystem: osfs.New(requested, osfs.WithBoundOS()), fb: s.fb, folder: folder, client: clientIP}, []nfs.AuthFlavor{nfs.AuthFlavorNull}
+}
+
+func (s *embeddedNfsServer) Change(fs billy.Filesystem) billy.Change {
+	if c, ok := fs.(billy.Change); ok {
+		return c
+	}
+	return nil
+}
+
+//FSStat reports the space left on the filesystem the NFS root lives on
+func (s *embeddedNfsServer) FSStat(ctx context.Context, fs billy.Filesystem, stat *nfs.FSStat) error {
+	var statfs syscall.Statfs_t
+	err := syscall.Statfs(fs.Root(), &statfs)
+	if err != nil {
+		return err
+	}
+
+	stat.TotalSize = statfs.Blocks * uint64(statfs.Bsize)
+	stat.FreeSize = statfs.Bfree * uint64(statfs.Bsize)
+	stat.AvailableSize = statfs.Bavail * uint64(statfs.Bsize)
+	stat.TotalFiles = statfs.Files
+	stat.FreeFiles = statfs.Ffree
+	stat.AvailableFiles = statfs.Ffree
+	return nil
+}
+
+//handles are provided by the caching handler that wraps this one
+func (s *embeddedNfsServer) ToHandle(fs billy.Filesystem, path []string) []byte {
+	return []byte{}
+}
+
+func (s *embeddedNfsServer) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
+	return nil, []string{}, nil
+}
+
+func (s *embeddedNfsServer) InvalidateHandle(fs billy.Filesystem, fh []byte) error {
+	return nil
+}
+
+func (s *embeddedNfsServer) HandleLimit() int {
+	return -1
+}
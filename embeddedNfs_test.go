@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+//startTestNfsServer serves an NFS root with one folder, disk1, from the embedded server on localhost
+func startTestNfsServer(t *testing.T) (*FileBackend, string) {
+	t.Helper()
+
+	nfsRoot := t.TempDir()
+	err := os.Mkdir(path.Join(nfsRoot, "disk1"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(nfsRoot, "disk1", "hello.txt"), []byte("hello pi"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := newFileBackend("127.0.0.1", nfsRoot, t.TempDir(), "3", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := backend.(*FileBackend)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &embeddedNfsServer{fb: fb}
+	go server.serve(listener)
+
+	return fb, listener.Addr().String()
+}
+
+func mountTestFolder(t *testing.T, address, folder string) (*nfsc.Target, error) {
+	t.Helper()
+
+	client, err := rpc.DialTCP("tcp", address, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	mounter := nfsc.Mount{Client: client}
+	return mounter.Mount(folder, rpc.AuthNull)
+}
+
+func TestEmbeddedNfsServesExportedFolder(t *testing.T) {
+	fb, address := startTestNfsServer(t)
+	fb.SetExportClients(context.Background(), map[string][]string{"disk1": {"127.0.0.1"}})
+
+	target, err := mountTestFolder(t, address, path.Join(fb.nfsRoot, "disk1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := target.Open("/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello pi" {
+		t.Errorf("read %q", content)
+	}
+}
+
+func TestEmbeddedNfsRefusesOtherClients(t *testing.T) {
+	fb, address := startTestNfsServer(t)
+	fb.SetExportClients(context.Background(), map[string][]string{"disk1": {"10.0.0.9"}})
+
+	_, err := mountTestFolder(t, address, path.Join(fb.nfsRoot, "disk1"))
+	if err == nil {
+		t.Error("a client the folder is not exported to mounted it")
+	}
+
+	_, err = mountTestFolder(t, address, fb.nfsRoot)
+	if err == nil {
+		t.Error("a client mounted the NFS root itself")
+	}
+}
+
+func TestEmbeddedNfsRevokesHandles(t *testing.T) {
+	fb, address := startTestNfsServer(t)
+	fb.SetExportClients(context.Background(), map[string][]string{"disk1": {"127.0.0.1"}})
+
+	target, err := mountTestFolder(t, address, path.Join(fb.nfsRoot, "disk1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = target.ReadDirPlus("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the pi is unbaked and the disk goes to another pi
+	fb.SetExportClients(context.Background(), map[string][]string{"disk1": {"10.0.0.9"}})
+
+	_, err = target.ReadDirPlus("/")
+	if err == nil {
+		t.Error("the folder can still be listed after its export was revoked")
+	}
+
+	file, err := target.Open("/hello.txt")
+	if err == nil {
+		_, err = ioutil.ReadAll(file)
+		file.Close()
+	}
+	if err == nil {
+		t.Error("a file can still be read after the export was revoked")
+	}
+}
+
+func TestEmbeddedNfsRefusesAttributesOutsideRoot(t *testing.T) {
+	fb, address := startTestNfsServer(t)
+	fb.SetExportClients(context.Background(), map[string][]string{"disk1": {"127.0.0.1"}})
+
+	outside := path.Join(t.TempDir(), "shadow")
+	err := ioutil.WriteFile(outside, []byte("host secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the pi plants a symlink to a host file in its own disk
+	err = os.Symlink(outside, path.Join(fb.nfsRoot, "disk1", "escape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := mountTestFolder(t, address, path.Join(fb.nfsRoot, "disk1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = target.Setattr("/escape", nfsc.Sattr3{Mode: nfsc.SetMode{SetIt: true, Mode: 0644}})
+	if err == nil {
+		t.Error("changing the mode through a symlink out of the root succeeded")
+	}
+
+	info, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the host file's mode changed to %v", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventBakeform = "bakeform"
+
+//busEvent is pushed to everyone watching /api/v1/events. Pi events carry the id of the pi, bakeform events the name of the bakeform.
+type busEvent struct {
+	Id       int64     `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	PiId     string    `json:"piId,omitempty"`
+	Bakeform string    `json:"bakeform,omitempty"`
+	Detail   string    `json:"detail"`
+}
+
+//eventBus hands out changes to the inventory as they happen, so clients don't have to poll the oven and the fridge
+type eventBus struct {
+	mutex       *sync.Mutex
+	lastId      int64
+	subscribers map[chan busEvent]bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		mutex:       &sync.Mutex{},
+		subscribers: make(map[chan busEvent]bool),
+	}
+}
+
+//Publish sends an event to every subscriber. It never blocks, a subscriber that can't keep up misses events.
+func (b *eventBus) Publish(e busEvent) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastId++
+	e.Id = b.lastId
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- e:
+		default:
+		}
+	}
+}
+
+func (b *eventBus) Subscribe() chan busEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	subscriber := make(chan busEvent, 64)
+	b.subscribers[subscriber] = true
+	return subscriber
+}
+
+func (b *eventBus) Unsubscribe(subscriber chan busEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscribers, subscriber)
+}
+
+//StreamHandler streams events as Server-Sent Events. ?types=status,power limits the stream to some event types, ?piId= to one pi.
+func (b *eventBus) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Streaming is not supported"))
+		return
+	}
+
+	types := make(map[string]bool)
+	if param := r.URL.Query().Get("types"); param != "" {
+		for _, t := range strings.Split(param, ",") {
+			types[t] = true
+		}
+	}
+	piId := r.URL.Query().Get("piId")
+
+	subscriber := b.Subscribe()
+	defer b.Unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	//comments keep proxies from closing an idle stream
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case e := <-subscriber:
+			if (len(types) > 0 && !types[e.Type]) || (piId != "" && e.PiId != piId) {
+				continue
+			}
+
+			jsonBytes, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+
+			fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", e.Id, e.Type, jsonBytes)
+			flusher.Flush()
+		}
+	}
+}
@@ -1,45 +1,75 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type fileBackend interface {
 	GetNfsRoot() string
 	GetNfsAddress() string
 	GetBootRoot() string
+	GetNfsVersion() string
+	GetNfsPath(folder string) string
+	GetNfsOptions() string
+	EnableEmbeddedNfs(address string) (*embeddedNfsServer, error)
+	SetExportClients(ctx context.Context, clients map[string][]string) error
 	PutFileInNfsFolder(filePath string, content []byte) error
 	GetFileFromNfsFolder(filePath string) ([]byte, error)
-	CreateNfsFolder(string) (string, error)
-	DeleteNfsFolder(string) error
+	CreateNfsFolder(ctx context.Context, folder string) (string, error)
+	DeleteNfsFolder(ctx context.Context, folder string) error
 	GetNfsFolders(string) []string
-	CopyNfsFolder(string, string) (string, error)
-	CopyBootFolder(string, string) (string, error)
+	CopyNfsFolder(ctx context.Context, source, dest string) (string, error)
+	CopyBootFolder(ctx context.Context, source, dest string) (string, error)
 }
 
 type FileBackend struct {
 	nfsRoot        string
 	nfsAddress     string
 	bootRoot       string
+	nfsVersion     string
+	exportFallback string
+	exportClients  map[string][]string
+	exporter       *nfsExporter
+	embeddedPort   string
 	nfsExportMutex *sync.Mutex
 }
 
-func newFileBackend(nfsAddress, nfsRoot, bootRoot string) (fileBackend, error) {
+//newFileBackend creates a file backend. Folders are exported with NFS version 3 or 4, in which case nfsRoot becomes the NFSv4 pseudo root.
+//Folders are only exported to the clients set with SetExportClients, folders without known clients are exported to exportFallback if set.
+//Without an exporter the kernel NFS server is left alone, folders are shared by the embedded server instead.
+func newFileBackend(nfsAddress, nfsRoot, bootRoot, nfsVersion, exportFallback string, exporter *nfsExporter) (fileBackend, error) {
 	if nfsAddress == "" || nfsRoot == "" {
 		return &FileBackend{}, fmt.Errorf("fileBackend: nfsAddress or nfsRoot not configured")
 	}
 
+	if nfsVersion == "" {
+		nfsVersion = "3"
+	}
+	if nfsVersion != "3" && nfsVersion != "4" {
+		return &FileBackend{}, fmt.Errorf("fileBackend: unsupported NFS version %v", nfsVersion)
+	}
+
 	return &FileBackend{
 		nfsRoot:        nfsRoot,
 		nfsAddress:     nfsAddress,
 		bootRoot:       bootRoot,
+		nfsVersion:     nfsVersion,
+		exportFallback: exportFallback,
+		exportClients:  make(map[string][]string),
+		exporter:       exporter,
 		nfsExportMutex: &sync.Mutex{},
 	}, nil
 }
@@ -56,11 +86,87 @@ func (nfs *FileBackend) GetBootRoot() string {
 	return nfs.bootRoot
 }
 
-func (f *FileBackend) copyFolder(s, d string) error {
-	_, err := exec.Command("rsync", "-xa", s, d).CombinedOutput()
+func (nfs *FileBackend) GetNfsVersion() string {
+	return nfs.nfsVersion
+}
+
+//GetNfsPath returns the path clients use to mount a folder. NFSv4 paths are relative to the pseudo root.
+func (nfs *FileBackend) GetNfsPath(folder string) string {
+	if nfs.nfsVersion == "4" {
+		return path.Join("/", strings.TrimPrefix(folder, nfs.nfsRoot))
+	}
+
+	return folder
+}
+
+//GetNfsOptions returns the mount options clients need for the NFS server in use
+func (nfs *FileBackend) GetNfsOptions() string {
+	if nfs.embeddedPort != "" {
+		//the embedded server has no portmapper and no lock manager
+		return fmt.Sprintf("vers=3,tcp,port=%v,mountport=%v,nolock", nfs.embeddedPort, nfs.embeddedPort)
+	}
+
+	return "vers=" + nfs.nfsVersion
+}
+
+//EnableEmbeddedNfs sets up the userspace NFS server that shares the folders in the NFS root. The caller starts it with ListenAndServe.
+func (nfs *FileBackend) EnableEmbeddedNfs(address string) (*embeddedNfsServer, error) {
+	if nfs.nfsVersion != "3" {
+		return nil, fmt.Errorf("fileBackend: the embedded NFS server only supports NFS version 3")
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	nfs.embeddedPort = port
+	return &embeddedNfsServer{address: address, fb: nfs}, nil
+}
+
+//SetExportClients sets the addresses each folder in the NFS root is exported to, keyed by folder name
+func (f *FileBackend) SetExportClients(ctx context.Context, clients map[string][]string) error {
+	f.nfsExportMutex.Lock()
+	f.exportClients = clients
+	f.nfsExportMutex.Unlock()
+
+	return f.regenNfsExports(ctx)
+}
+
+//exportedTo returns true if the folder in the NFS root is exported to client
+func (f *FileBackend) exportedTo(folder, client string) bool {
+	f.nfsExportMutex.Lock()
+	defer f.nfsExportMutex.Unlock()
+
+	clients := f.exportClients[folder]
+	if len(clients) == 0 && f.exportFallback != "" {
+		clients = []string{f.exportFallback}
+	}
+
+	for _, c := range clients {
+		if c == "*" || c == client {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(c); err == nil && network.Contains(net.ParseIP(client)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *FileBackend) copyFolder(ctx context.Context, s, d string) (err error) {
+	_, span := startSpan(ctx, "FileBackend.copyFolder", attribute.String("bakery.source", s), attribute.String("bakery.destination", d))
+	defer func() { endSpan(span, err) }()
+
+	loggerFrom(ctx).Debug("Copying folder", "source", s, "destination", d)
+	out, err := exec.Command("rsync", "-xa", s, d).CombinedOutput()
 	if err != nil && err.Error() != "exit status 23" { //avoid bug in ubuntu 14.04
 		return err
 	}
+	if err != nil {
+		loggerFrom(ctx).Warn("Some files were not copied", "source", s, "destination", d, "output", string(out))
+	}
 
 	return nil
 }
@@ -82,40 +188,40 @@ func (f *FileBackend) GetFileFromNfsFolder(filePath string) ([]byte, error) {
 	return ioutil.ReadFile(fullFilePath)
 }
 
-func (f *FileBackend) CopyBootFolder(s, dest string) (string, error) {
+func (f *FileBackend) CopyBootFolder(ctx context.Context, s, dest string) (string, error) {
 	d := path.Join(f.bootRoot, dest)
 	//d = strings.Replace(d, "//", "/", -1)
-	return d, f.copyFolder(s, d)
+	return d, f.copyFolder(ctx, s, d)
 }
 
-func (f *FileBackend) CopyNfsFolder(s, dest string) (string, error) {
+func (f *FileBackend) CopyNfsFolder(ctx context.Context, s, dest string) (string, error) {
 	d := path.Join(f.nfsRoot, dest)
 	//d = strings.Replace(d, "//", "/", -1)
-	err := f.copyFolder(s, d)
+	err := f.copyFolder(ctx, s, d)
 	if err != nil {
 		return "", err
 	}
 
-	return d, f.regenNfsExports()
+	return d, f.regenNfsExports(ctx)
 }
 
-func (f *FileBackend) CreateNfsFolder(d string) (string, error) {
+func (f *FileBackend) CreateNfsFolder(ctx context.Context, d string) (string, error) {
 	location := path.Join(f.nfsRoot, d)
 	err := os.Mkdir(location, 0644)
 	if err != nil {
 		return "", err
 	}
-	err = f.regenNfsExports()
+	err = f.regenNfsExports(ctx)
 	return location, err
 }
 
-func (f *FileBackend) DeleteNfsFolder(d string) error {
+func (f *FileBackend) DeleteNfsFolder(ctx context.Context, d string) error {
 	location := path.Join(f.nfsRoot, d)
 	err := os.RemoveAll(location)
 	if err != nil {
 		return err
 	}
-	return f.regenNfsExports()
+	return f.regenNfsExports(ctx)
 }
 
 func (f *FileBackend) GetNfsFolders(pattern string) []string {
@@ -123,23 +229,64 @@ func (f *FileBackend) GetNfsFolders(pattern string) []string {
 	return files
 }
 
-func (f *FileBackend) regenNfsExports() error {
+func (f *FileBackend) regenNfsExports(ctx context.Context) (err error) {
+	if f.exporter == nil {
+		return nil //the embedded server checks exportClients on every mount
+	}
+
+	_, span := startSpan(ctx, "FileBackend.regenNfsExports")
+	defer func() { endSpan(span, err) }()
+
 	f.nfsExportMutex.Lock()
 	defer f.nfsExportMutex.Unlock()
 
+	start := time.Now()
+	defer func() {
+		nfsExportRegenDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	folderList := f.GetNfsFolders("*")
 
+	exportOptions := "rw,sync,no_subtree_check,no_root_squash,crossmnt"
 	exportsContent := ""
+	allClients := make(map[string]bool)
 	for _, folder := range folderList {
-		exportsContent = exportsContent + fmt.Sprintf("%v *(rw,sync,no_subtree_check,no_root_squash)\n", folder)
+		clients := f.exportClients[path.Base(folder)]
+		if len(clients) == 0 && f.exportFallback != "" {
+			clients = []string{f.exportFallback}
+		}
+
+		if len(clients) == 0 {
+			exportsContent = exportsContent + fmt.Sprintf("#%v has no known clients\n", folder)
+			continue
+		}
+
+		line := folder
+		for _, client := range clients {
+			line = line + fmt.Sprintf(" %v(%v)", client, exportOptions)
+			allClients[client] = true
+		}
+		exportsContent = exportsContent + line + "\n"
 	}
 
-	log.Println("Generated new exports file:\n" + exportsContent)
-	err := ioutil.WriteFile("/etc/exports", []byte(exportsContent), 0644)
-	if err != nil {
-		return err
+	//NFSv4 clients mount paths relative to the pseudo root, every client needs to see it
+	if f.nfsVersion == "4" && len(allClients) > 0 {
+		var pseudoRootClients []string
+		for client := range allClients {
+			pseudoRootClients = append(pseudoRootClients, client)
+		}
+		sort.Strings(pseudoRootClients)
+
+		line := f.nfsRoot
+		for _, client := range pseudoRootClients {
+			line = line + fmt.Sprintf(" %v(ro,fsid=0,no_subtree_check)", client)
+		}
+		exportsContent = line + "\n" + exportsContent
 	}
 
-	_, err = exec.Command("exportfs", "-a").CombinedOutput()
+	changed, err := f.exporter.Apply(ctx, exportsContent)
+	if changed {
+		loggerFrom(ctx).Debug("Generated new exports file", "exports", exportsContent)
+	}
 	return err
 }
@@ -1,35 +1,110 @@
 package main
 
 import (
-	"html/template"
-	"log"
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type fileServer interface {
 	fileHandler(http.ResponseWriter, *http.Request)
+	openPiFile(ctx context.Context, piId, filename, remoteAddress string, direct bool) (*bootFile, error)
+	bootImageHandler(http.ResponseWriter, *http.Request)
+	bootSigHandler(http.ResponseWriter, *http.Request)
 }
 
 type FileServer struct {
-	nfs         fileBackend
-	piInventory piManager
-	diskManager *diskManager
+	nfs            fileBackend
+	piInventory    piManager
+	diskManager    *diskManager
+	overrideRoot   string
+	templatedFiles map[string]bool
+	httpBootRoot   string
+	httpBootMutex  *sync.Mutex            //guards httpBootLocks
+	httpBootLocks  map[string]*sync.Mutex //one per pi, held while its boot image is looked up or built
+	signingKey     *rsa.PrivateKey
 }
 
 type templatevars struct {
-	PiId      string
-	NfsServer string
-	NfsRoot   string
+	PiId       string
+	Hostname   string
+	Labels     map[string]string
+	Disks      []*disk
+	Bakeform   *Bakeform
+	KernelArgs string
+	NfsServer  string
+	NfsRoot    string
+	NfsVersion string
+	NfsOptions string
+	RootMode   diskMode
+	NbdServer  string
+	NbdPort    string
+	NbdExport  string
 }
 
-func newFileServer(nfs fileBackend, inventory piManager, dm *diskManager) (fileServer, error) {
+//bootFile is the content of a boot file as it should be served to a specific pi
+type bootFile struct {
+	io.ReadSeeker
+	name    string
+	modTime time.Time
+	size    int64
+}
+
+func (b *bootFile) Close() error {
+	if closer, ok := b.ReadSeeker.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+//errPiNotInUse is returned for pis that should not be booting
+var errPiNotInUse = fmt.Errorf("Pi is not in use")
+
+//newFileServer creates a file server. templatedFiles is the list of boot files that are parsed as templates before serving.
+//Files in overrideRoot/pis/{piId}/ and overrideRoot/bakeforms/{bakeformName}/ take precedence over the bakeform's boot files.
+//Boot images for HTTP boot are built in httpBootRoot and signed with the key at signingKeyPath, if set.
+func newFileServer(nfs fileBackend, inventory piManager, dm *diskManager, overrideRoot string, templatedFiles []string, httpBootRoot, signingKeyPath string) (fileServer, error) {
+	templated := make(map[string]bool)
+	for _, filename := range templatedFiles {
+		filename = strings.TrimSpace(filename)
+		if filename != "" {
+			templated[path.Clean("/" + filename)[1:]] = true
+		}
+	}
+
+	var signingKey *rsa.PrivateKey
+	if signingKeyPath != "" {
+		var err error
+		signingKey, err = loadSigningKey(signingKeyPath)
+		if err != nil {
+			return &FileServer{}, fmt.Errorf("Unable to load boot image signing key. %v", err)
+		}
+	}
+
 	return &FileServer{
-		nfs:         nfs,
-		piInventory: inventory,
-		diskManager: dm,
+		nfs:            nfs,
+		piInventory:    inventory,
+		diskManager:    dm,
+		overrideRoot:   overrideRoot,
+		templatedFiles: templated,
+		httpBootRoot:   httpBootRoot,
+		httpBootMutex:  &sync.Mutex{},
+		httpBootLocks:  make(map[string]*sync.Mutex),
+		signingKey:     signingKey,
 	}, nil
 }
 
@@ -38,48 +113,173 @@ func (f *FileServer) fileHandler(w http.ResponseWriter, r *http.Request) {
 	filename := urlvars["filename"]
 	piId := urlvars["piId"]
 
+	//the files api is also used by TFTP proxies, the address a request comes from need not be the pi's
+	remoteAddress, _, _ := net.SplitHostPort(r.RemoteAddr)
+	file, err := f.openPiFile(r.Context(), piId, filename, remoteAddress, false)
+	if err != nil {
+		if err == errPiNotInUse || os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	http.ServeContent(w, r, file.name, file.modTime, file)
+}
+
+//openPiFile returns a boot file for the pi with the given id. Used by every protocol pis can boot over.
+//direct is true if the pi itself requests the file, as over TFTP, and not a proxy on its behalf.
+func (f *FileServer) openPiFile(ctx context.Context, piId, filename, remoteAddress string, direct bool) (*bootFile, error) {
+	logger := loggerFrom(ctx).With("piId", piId, "filename", filename)
+	pi, err := f.bootingPi(ctx, piId, remoteAddress, direct)
+	if err != nil {
+		pi.event(eventBootFile, "%v refused: %v", filename, err)
+		bootFileRequests.WithLabelValues("", "refused").Inc()
+		return nil, err
+	}
+
+	file, err := f.openBootFile(pi, filename)
+	if err != nil {
+		logger.Warn("Unable to serve boot file", "error", err)
+		pi.event(eventBootFile, "%v failed: %v", filename, err)
+		if os.IsNotExist(err) {
+			bootFileRequests.WithLabelValues("", "notfound").Inc()
+		} else {
+			bootFileRequests.WithLabelValues("", "failed").Inc()
+		}
+		return nil, err
+	}
+
+	logger.Debug("Serving boot file")
+	pi.event(eventBootFile, "%v", filename)
+	bootFileRequests.WithLabelValues(filename, "served").Inc()
+	return file, nil
+}
+
+//bootingPi looks up a pi that requests boot files. Unknown pis are registered and put in the fridge.
+//Pis that are not in use are powered off and errPiNotInUse is returned. The address of pis that are in use is recorded to restrict NFS exports,
+//but only from requests the pi sent directly. A request relayed by a proxy comes from the proxy's address.
+func (f *FileServer) bootingPi(ctx context.Context, piId, remoteAddress string, direct bool) (PiInfo, error) {
+	logger := loggerFrom(ctx).With("piId", piId)
+
 	//check if piId is allready registered. If not then register.
 	pi, err := f.piInventory.GetPi(piId)
 	if err != nil {
-		log.Println("Pi not found in inventory. Putting a new one in the fridge.")
+		logger.Info("Pi not found in inventory. Putting a new one in the fridge.", "address", remoteAddress)
 		pi = f.piInventory.NewPi(piId)
-		err = pi.Save()
+		err = pi.Save(ctx)
 		if err != nil {
 			panic(err)
 		}
+		pi.event(eventRegistered, "first seen at %v", remoteAddress)
 	}
 
 	if pi.Status == NOTINUSE {
 		//Pi is not in inventory or not in use. Then don't serve files and power it off
-		log.Printf("Pi %v came online but it's not in use. Powering it off\n", pi.Id)
-		err = pi.PowerOff()
+		logger.Info("Pi came online but it's not in use. Powering it off")
+		err = pi.PowerOff(ctx)
 		if err != nil {
-			log.Println("A Pi just came online but I can't control its power state. Error:" + err.Error())
+			logger.Error("A Pi just came online but I can't control its power state", "error", err)
 		}
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return pi, errPiNotInUse
 	}
 
-	//if filename == cmdline.txt then parse the template. else just serve the file
-	bootLocation := pi.SourceBakeform.bootLocation
-	//strings.Replace(bootLocation, "/", "", 1) //remove the first /
-	fullFilename := path.Join(bootLocation, filename)
+	if pi.SourceBakeform == nil || len(pi.Disks) == 0 || pi.Disks[0] == nil {
+		logger.Info("Pi came online but it's not baked yet")
+		return pi, errPiNotInUse
+	}
 
-	if filename != "cmdline.txt" {
-		http.ServeFile(w, r, fullFilename)
-		return
-	} else {
+	if direct {
+		f.piInventory.LearnAddress(ctx, pi, remoteAddress)
+	}
+
+	return pi, nil
+}
+
+//resolveBootFile finds the file to serve for a pi. Per pi overrides win over per bakeform overrides, which win over the bakeform itself.
+func (f *FileServer) resolveBootFile(pi PiInfo, filename string) string {
+	candidates := []string{
+		path.Join(f.overrideRoot, "pis", pi.Id, filename),
+		path.Join(f.overrideRoot, "bakeforms", pi.SourceBakeform.Name, filename),
+	}
+
+	for _, candidate := range candidates {
+		if fi, err := os.Stat(candidate); err == nil && !fi.IsDir() {
+			return candidate
+		}
+	}
+
+	return path.Join(pi.SourceBakeform.bootLocation, filename)
+}
+
+//openBootFile returns a boot file for a pi. Templated files are rendered and per pi boot config is merged in, everything else is served as is.
+func (f *FileServer) openBootFile(pi PiInfo, filename string) (*bootFile, error) {
+	filename = path.Clean("/" + filename)[1:] //never leave the boot folder
+	fullFilename := f.resolveBootFile(pi, filename)
+
+	fd, err := os.Open(fullFilename)
+	if err != nil {
+		return nil, err
+	}
 
-		c := templatevars{
-			NfsServer: f.nfs.GetNfsAddress(),
-			NfsRoot:   pi.Disks[0].Location,
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		fd.Close()
+		return nil, os.ErrNotExist
+	}
+
+	templated := f.templatedFiles[filename]
+	if !templated && !pi.BootConfig.appliesTo(filename) {
+		return &bootFile{ReadSeeker: fd, name: filename, modTime: fi.ModTime(), size: fi.Size()}, nil
+	}
+
+	defer fd.Close()
+	content, err := ioutil.ReadAll(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	if templated {
+		t, err := template.New(filename).Parse(string(content))
+		if err != nil {
+			return nil, err
 		}
 
-		log.Printf("%v requested for: %v\n", filename, pi.Id)
-		t, err := template.New("templatefile").ParseFiles(fullFilename)
+		var buf bytes.Buffer
+		err = t.Execute(&buf, f.templateVars(pi))
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		t.ExecuteTemplate(w, filename, c)
+		content = buf.Bytes()
+	}
+
+	//per pi overrides set through the api go on top of whatever the bakeform provides
+	content = pi.BootConfig.merge(filename, content)
+
+	return &bootFile{ReadSeeker: bytes.NewReader(content), name: filename, modTime: time.Now(), size: int64(len(content))}, nil
+}
+
+func (f *FileServer) templateVars(pi PiInfo) templatevars {
+	return templatevars{
+		PiId:       pi.Id,
+		Hostname:   pi.Hostname,
+		Labels:     pi.Labels,
+		Disks:      pi.Disks,
+		Bakeform:   pi.SourceBakeform,
+		KernelArgs: pi.KernelArgs,
+		NfsServer:  f.nfs.GetNfsAddress(),
+		NfsRoot:    f.nfs.GetNfsPath(pi.Disks[0].Location),
+		NfsVersion: f.nfs.GetNfsVersion(),
+		NfsOptions: f.nfs.GetNfsOptions(),
+		RootMode:   pi.Disks[0].Mode,
+		NbdServer:  f.nfs.GetNfsAddress(),
+		NbdPort:    f.diskManager.nbdPort,
+		NbdExport:  pi.Disks[0].ID,
 	}
 }
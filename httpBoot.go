@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+//Pi 4 and newer EEPROMs can boot a FAT image over HTTP. Set HTTP_HOST to the bakery and HTTP_PATH to api/v1/httpboot/{serial}
+//in the EEPROM config, the firmware then fetches boot.img and boot.sig from that path.
+
+//loadSigningKey reads a PEM encoded RSA private key used to sign boot images
+func loadSigningKey(keyPath string) (*rsa.PrivateKey, error) {
+	pemBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %v", keyPath)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Signing key in %v is not an RSA key", keyPath)
+	}
+
+	return rsaKey, nil
+}
+
+func (f *FileServer) bootImageHandler(w http.ResponseWriter, r *http.Request) {
+	piId := mux.Vars(r)["piId"]
+
+	logger := loggerFrom(r.Context()).With("piId", piId)
+
+	remoteAddress, _, _ := net.SplitHostPort(r.RemoteAddr)
+	pi, err := f.bootingPi(r.Context(), piId, remoteAddress, true)
+	if err != nil {
+		pi.event(eventBootFile, "boot.img refused: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	image, err := f.bootImage(pi)
+	if err != nil {
+		logger.Error("Unable to build boot image", "error", err)
+		pi.event(eventBootFile, "boot.img failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer image.Close()
+
+	fi, err := image.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("boot.img requested")
+	pi.event(eventBootFile, "boot.img")
+	http.ServeContent(w, r, "boot.img", fi.ModTime(), image)
+}
+
+func (f *FileServer) bootSigHandler(w http.ResponseWriter, r *http.Request) {
+	piId := mux.Vars(r)["piId"]
+
+	logger := loggerFrom(r.Context()).With("piId", piId)
+
+	remoteAddress, _, _ := net.SplitHostPort(r.RemoteAddr)
+	pi, err := f.bootingPi(r.Context(), piId, remoteAddress, true)
+	if err != nil {
+		pi.event(eventBootFile, "boot.sig refused: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	//the image is cached per content, so this is the image the pi just downloaded unless its boot files changed since
+	image, err := f.bootImage(pi)
+	if err != nil {
+		logger.Error("Unable to build boot image", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer image.Close()
+
+	sig, err := f.signBootImage(image)
+	if err != nil {
+		logger.Error("Unable to sign boot image", "error", err)
+		pi.event(eventBootFile, "boot.sig failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	pi.event(eventBootFile, "boot.sig")
+	w.Write(sig)
+}
+
+//signBootImage generates the boot.sig contents in the format of rpi-eeprom-digest: the SHA-256 of the image,
+//the time the image was built and, when a signing key is configured, an RSA signature of the image.
+func (f *FileServer) signBootImage(image *os.File) ([]byte, error) {
+	fi, err := image.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, io.NewSectionReader(image, 0, fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+	digest := h.Sum(nil)
+
+	sig := fmt.Sprintf("%v\nts: %v\n", hex.EncodeToString(digest), fi.ModTime().Unix())
+
+	if f.signingKey != nil {
+		signature, err := rsa.SignPKCS1v15(nil, f.signingKey, crypto.SHA256, digest)
+		if err != nil {
+			return nil, err
+		}
+		sig = sig + fmt.Sprintf("rsa2048: %v\n", hex.EncodeToString(signature))
+	}
+
+	return []byte(sig), nil
+}
+
+//bootImage returns the boot image of a pi, opened for reading. Images are built once per pi and version of the boot files,
+//so boot.img and boot.sig always come from the same build. The image is opened under the lock of the pi, a rebuild can't replace it while it is served.
+func (f *FileServer) bootImage(pi PiInfo) (*os.File, error) {
+	lock := f.httpBootLock(pi.Id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	fingerprint, err := f.bootFilesFingerprint(pi)
+	if err != nil {
+		return nil, err
+	}
+
+	workDir := path.Join(f.httpBootRoot, pi.Id)
+	imagePath := path.Join(workDir, "boot-"+fingerprint[:16]+".img")
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		stageDir := path.Join(workDir, "stage")
+		err = os.RemoveAll(stageDir)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.MkdirAll(stageDir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(stageDir)
+
+		totalSize, err := f.stageBootFiles(pi, stageDir)
+		if err != nil {
+			return nil, err
+		}
+
+		err = f.buildBootImage(pi, stageDir, totalSize, imagePath)
+		if err != nil {
+			return nil, err
+		}
+
+		//images of older boot files are not served anymore. Transfers that are running keep their open file.
+		previous, _ := filepath.Glob(path.Join(workDir, "boot*.img"))
+		for _, p := range previous {
+			if p != imagePath {
+				os.Remove(p)
+			}
+		}
+	}
+
+	return os.Open(imagePath)
+}
+
+func (f *FileServer) httpBootLock(piId string) *sync.Mutex {
+	f.httpBootMutex.Lock()
+	defer f.httpBootMutex.Unlock()
+
+	lock, exists := f.httpBootLocks[piId]
+	if !exists {
+		lock = &sync.Mutex{}
+		f.httpBootLocks[piId] = lock
+	}
+	return lock
+}
+
+//bootFilesFingerprint identifies the version of the boot files of a pi without reading them all. Files served as is count with
+//the path they are served from, their size and modification time. Templated files and files with per pi boot config are rendered, they are small.
+func (f *FileServer) bootFilesFingerprint(pi PiInfo) (string, error) {
+	files := f.listBootFiles(pi)
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, filename := range files {
+		if !f.templatedFiles[filename] && !pi.BootConfig.appliesTo(filename) {
+			fullFilename := f.resolveBootFile(pi, filename)
+			fi, err := os.Stat(fullFilename)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%v\x00%v\x00%v\x00%v\x00", filename, fullFilename, fi.Size(), fi.ModTime().UnixNano())
+			continue
+		}
+
+		file, err := f.openBootFile(pi, filename)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%v\x00", filename)
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "\x00")
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//stageBootFiles copies every boot file of the pi, exactly as they would be served over TFTP or the files api, to stageDir.
+//It returns the total size of the files.
+func (f *FileServer) stageBootFiles(pi PiInfo, stageDir string) (int64, error) {
+	var totalSize int64
+	for _, filename := range f.listBootFiles(pi) {
+		file, err := f.openBootFile(pi, filename)
+		if err != nil {
+			return 0, err
+		}
+
+		target := path.Join(stageDir, filename)
+		err = os.MkdirAll(path.Dir(target), 0755)
+		if err == nil {
+			var fd *os.File
+			fd, err = os.Create(target)
+			if err == nil {
+				var n int64
+				n, err = io.Copy(fd, file)
+				totalSize += n
+				fd.Close()
+			}
+		}
+		file.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return totalSize, nil
+}
+
+//buildBootImage creates a FAT image at imagePath with the files in stageDir
+func (f *FileServer) buildBootImage(pi PiInfo, stageDir string, totalSize int64, imagePath string) error {
+	//build next to the target and rename, so a half built image is never served
+	tmpPath := imagePath + ".tmp"
+	os.Remove(tmpPath)
+	defer os.Remove(tmpPath)
+
+	//leave room for FAT overhead. The volume id is derived from the pi id so images of the same pi look alike.
+	sizeKB := totalSize/1024 + totalSize/1024/5 + 4096
+	volumeId := fnv.New32a()
+	volumeId.Write([]byte(pi.Id))
+
+	out, err := exec.Command("mkfs.vfat", "-C", "-n", "BOOT", "-i", fmt.Sprintf("%08x", volumeId.Sum32()), tmpPath, fmt.Sprintf("%v", sizeKB)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mkfs.vfat failed: %v %v", err, string(out))
+	}
+
+	entries, err := ioutil.ReadDir(stageDir)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) > 0 {
+		args := []string{"-s", "-p", "-m", "-i", tmpPath}
+		for _, entry := range entries {
+			args = append(args, path.Join(stageDir, entry.Name()))
+		}
+		args = append(args, "::/")
+
+		out, err = exec.Command("mcopy", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("mcopy failed: %v %v", err, string(out))
+		}
+	}
+
+	return os.Rename(tmpPath, imagePath)
+}
+
+//listBootFiles returns the relative paths of all boot files of a pi, including files that only exist as an override
+func (f *FileServer) listBootFiles(pi PiInfo) []string {
+	seen := make(map[string]bool)
+	var files []string
+
+	roots := []string{
+		pi.SourceBakeform.bootLocation,
+		path.Join(f.overrideRoot, "bakeforms", pi.SourceBakeform.Name),
+		path.Join(f.overrideRoot, "pis", pi.Id),
+	}
+
+	for _, root := range roots {
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+
+			rel := strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+			if !seen[rel] {
+				seen[rel] = true
+				files = append(files, rel)
+			}
+			return nil
+		})
+	}
+
+	return files
+}
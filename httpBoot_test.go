@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestBootFilesFingerprint(t *testing.T) {
+	bootLocation := t.TempDir()
+	overrideRoot := t.TempDir()
+	err := ioutil.WriteFile(path.Join(bootLocation, "kernel8.img"), []byte("kernel"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &FileServer{overrideRoot: overrideRoot, templatedFiles: map[string]bool{}}
+	pi := PiInfo{Id: "00000000abcd", SourceBakeform: &Bakeform{Name: "raspbian", bootLocation: bootLocation}}
+
+	first, err := f.bootFilesFingerprint(pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := f.bootFilesFingerprint(pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != again {
+		t.Error("the fingerprint of unchanged boot files changed")
+	}
+
+	//a bakeform that was written again gets a new image
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(path.Join(bootLocation, "kernel8.img"), later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	touched, err := f.bootFilesFingerprint(pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if touched == first {
+		t.Error("the fingerprint did not change with the modification time of a boot file")
+	}
+
+	//so does a pi with an override
+	err = os.MkdirAll(path.Join(overrideRoot, "pis", pi.Id), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(overrideRoot, "pis", pi.Id, "kernel8.img"), []byte("patched kernel"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overridden, err := f.bootFilesFingerprint(pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overridden == touched {
+		t.Error("the fingerprint did not change with an override")
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+//inventoryStore keeps the pis and disks of bakery
+type inventoryStore interface {
+	SavePi(p piRecord) error
+	GetPi(id string) (piRecord, error)
+	ListPis(status piStatus) ([]piRecord, error)
+	ClaimPi(id string, from, to piStatus) (bool, error)
+	SaveDisk(d diskRecord) error
+	GetDisk(id string) (diskRecord, error)
+	ListDisks() ([]diskRecord, error)
+	DeleteDisk(id string) error
+	AppendAudit(e auditEntry) error
+	ListAudit(f auditFilter) ([]auditEntry, error)
+	AppendEvent(e piEvent, keep int) error
+	ListEvents(piId string, limit int) ([]piEvent, error)
+	PendingTask(name string) (bool, error)
+	FinishTask(name string) error
+}
+
+//taskAdoptDiskFolders adds the folders of an inventory from before disks were kept in it as disks
+const taskAdoptDiskFolders = "adoptDiskFolders"
+
+//inventoryRepo is the inventoryStore for sqlite and PostgreSQL, and the only place that talks SQL.
+//All statements are prepared once, values are always passed as parameters.
+type inventoryRepo struct {
+	db      *sql.DB
+	dialect sqlDialect
+	stmts   map[string]*sql.Stmt
+}
+
+//piRecord is a pi as it is stored in the inventory
+type piRecord struct {
+	Id            string
+	Status        piStatus
+	Bakeform      string
+	Hostname      string
+	Labels        string
+	KernelArgs    string
+	BootConfig    string
+	Address       string
+	AddressPinned bool
+	DiskIds       []string //by position, the root disk first. Empty ids are unused positions.
+}
+
+//diskRecord is the metadata of a disk as it is stored in the inventory
+type diskRecord struct {
+	Id             string
+	Location       string
+	CreatedAt      time.Time
+	SourceBakeform string
+	Owner          string
+	Quota          int64
+}
+
+const piColumns = "id, status, bakeform, hostname, labels, kernelArgs, bootConfig, address, addressPinned"
+
+var inventoryStatements = map[string]string{
+	"upsertPi": "insert into inventory(id, status, bakeform, diskIds, hostname, labels, kernelArgs, bootConfig, address, addressPinned) values(?, ?, ?, '', ?, ?, ?, ?, ?, ?) " +
+		"on conflict(id) do update set status = excluded.status, bakeform = excluded.bakeform, diskIds = '', hostname = excluded.hostname, labels = excluded.labels, " +
+		"kernelArgs = excluded.kernelArgs, bootConfig = excluded.bootConfig, address = excluded.address, addressPinned = excluded.addressPinned",
+	"getPi":         "select " + piColumns + " from inventory where id = ?",
+	"listPis":       "select " + piColumns + " from inventory where status = ?",
+	"claimPi":       "update inventory set status = ? where id = ? and status = ?",
+	"piDisks":       "select diskId, position from pi_disks where piId = ? order by position",
+	"clearPiDisks":  "delete from pi_disks where piId = ?",
+	"insertPiDisk":  "insert into pi_disks(piId, diskId, position) values(?, ?, ?)",
+	"upsertDisk":    "insert into disks(id, location, createdAt, sourceBakeform, owner, quota) values(?, ?, ?, ?, ?, ?) on conflict(id) do update set location = excluded.location, sourceBakeform = excluded.sourceBakeform, owner = excluded.owner, quota = excluded.quota",
+	"listDisks":     "select id, location, createdAt, sourceBakeform, owner, quota from disks",
+	"getDisk":       "select id, location, createdAt, sourceBakeform, owner, quota from disks where id = ?",
+	"deleteDisk":    "delete from disks where id = ?",
+	"detachDiskAll": "delete from pi_disks where diskId = ?",
+	"appendAudit":   "insert into audit_log(time, actor, action, targetType, target, status, result, error) values(?, ?, ?, ?, ?, ?, ?, ?)",
+	"appendEvent":   "insert into pi_events(piId, time, type, detail) values(?, ?, ?, ?)",
+	"pruneEvents":   "delete from pi_events where piId = ? and id <= (select id from pi_events where piId = ? order by id desc limit 1 offset ?)",
+	"listEvents":    "select id, piId, time, type, detail from pi_events where piId = ? order by id desc limit ?",
+	"pendingTask":   "select count(*) from inventory_tasks where name = ?",
+	"finishTask":    "delete from inventory_tasks where name = ?",
+}
+
+//openInventory opens the inventory and migrates it to the current schema. dsn is a sqlite file or a postgres:// URL.
+func openInventory(dsn string) (inventoryStore, error) {
+	dialect := dialectFor(dsn)
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrate(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &inventoryRepo{
+		db:      db,
+		dialect: dialect,
+		stmts:   make(map[string]*sql.Stmt),
+	}
+
+	for name, query := range inventoryStatements {
+		repo.stmts[name], err = db.Prepare(dialect.rebind(query))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return repo, nil
+}
+
+//SavePi inserts or updates a pi together with its disks
+func (r *inventoryRepo) SavePi(p piRecord) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Stmt(r.stmts["upsertPi"]).Exec(p.Id, p.Status, p.Bakeform, p.Hostname, p.Labels, p.KernelArgs, p.BootConfig, p.Address, p.AddressPinned)
+	if err == nil {
+		_, err = tx.Stmt(r.stmts["clearPiDisks"]).Exec(p.Id)
+	}
+
+	for position, diskId := range p.DiskIds {
+		if err != nil {
+			break
+		}
+		if diskId != "" {
+			_, err = tx.Stmt(r.stmts["insertPiDisk"]).Exec(p.Id, diskId, position)
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//GetPi returns the pi with the given id. sql.ErrNoRows is returned if there is no such pi.
+func (r *inventoryRepo) GetPi(id string) (piRecord, error) {
+	rows, err := r.stmts["getPi"].Query(id)
+	if err != nil {
+		return piRecord{}, err
+	}
+
+	records, err := r.scanPis(rows)
+	if err != nil {
+		return piRecord{}, err
+	}
+	if len(records) == 0 {
+		return piRecord{}, sql.ErrNoRows
+	}
+
+	return records[0], nil
+}
+
+//ListPis returns all pis with the given status
+func (r *inventoryRepo) ListPis(status piStatus) ([]piRecord, error) {
+	rows, err := r.stmts["listPis"].Query(status)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.scanPis(rows)
+}
+
+//ClaimPi moves a pi from one status to another, if it still has the from status.
+//Bakeries sharing the inventory may claim the same pi at once, only one of them gets true.
+func (r *inventoryRepo) ClaimPi(id string, from, to piStatus) (bool, error) {
+	result, err := r.stmts["claimPi"].Exec(to, id, from)
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := result.RowsAffected()
+	return claimed == 1, err
+}
+
+func (r *inventoryRepo) scanPis(rows *sql.Rows) ([]piRecord, error) {
+	var records []piRecord
+	for rows.Next() {
+		var p piRecord
+		err := rows.Scan(&p.Id, &p.Status, &p.Bakeform, &p.Hostname, &p.Labels, &p.KernelArgs, &p.BootConfig, &p.Address, &p.AddressPinned)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		records = append(records, p)
+	}
+	rows.Close()
+
+	for i := range records {
+		diskIds, err := r.piDisks(records[i].Id)
+		if err != nil {
+			return nil, err
+		}
+		records[i].DiskIds = diskIds
+	}
+
+	return records, rows.Err()
+}
+
+func (r *inventoryRepo) piDisks(piId string) ([]string, error) {
+	rows, err := r.stmts["piDisks"].Query(piId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var diskIds []string
+	for rows.Next() {
+		var diskId string
+		var position int
+		err = rows.Scan(&diskId, &position)
+		if err != nil {
+			return nil, err
+		}
+
+		for len(diskIds) <= position {
+			diskIds = append(diskIds, "")
+		}
+		diskIds[position] = diskId
+	}
+
+	return diskIds, rows.Err()
+}
+
+//SaveDisk inserts or updates the metadata of a disk. The creation time of an existing disk is never changed.
+func (r *inventoryRepo) SaveDisk(d diskRecord) error {
+	_, err := r.stmts["upsertDisk"].Exec(d.Id, d.Location, d.CreatedAt, d.SourceBakeform, d.Owner, d.Quota)
+	return err
+}
+
+func (r *inventoryRepo) ListDisks() ([]diskRecord, error) {
+	rows, err := r.stmts["listDisks"].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []diskRecord
+	for rows.Next() {
+		var d diskRecord
+		err = rows.Scan(&d.Id, &d.Location, &d.CreatedAt, &d.SourceBakeform, &d.Owner, &d.Quota)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, d)
+	}
+
+	return records, rows.Err()
+}
+
+//GetDisk returns the disk with the given id. sql.ErrNoRows is returned if there is no such disk.
+func (r *inventoryRepo) GetDisk(id string) (diskRecord, error) {
+	var d diskRecord
+	err := r.stmts["getDisk"].QueryRow(id).Scan(&d.Id, &d.Location, &d.CreatedAt, &d.SourceBakeform, &d.Owner, &d.Quota)
+	return d, err
+}
+
+//DeleteDisk removes a disk and detaches it from every pi
+func (r *inventoryRepo) DeleteDisk(id string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Stmt(r.stmts["deleteDisk"]).Exec(id)
+	if err == nil {
+		_, err = tx.Stmt(r.stmts["detachDiskAll"]).Exec(id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *inventoryRepo) AppendAudit(e auditEntry) error {
+	_, err := r.stmts["appendAudit"].Exec(e.Time, e.Actor, e.Action, e.TargetType, e.Target, e.Status, e.Result, e.Error)
+	return err
+}
+
+//ListAudit returns the audit entries matching the filter, newest first
+func (r *inventoryRepo) ListAudit(f auditFilter) ([]auditEntry, error) {
+	var conditions []string
+	var args []interface{}
+	for column, value := range map[string]string{"actor": f.Actor, "action": f.Action, "targetType": f.TargetType, "target": f.Target, "result": f.Result} {
+		if value != "" {
+			conditions = append(conditions, column+" = ?")
+			args = append(args, value)
+		}
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, f.Since)
+	}
+	if !f.Until.IsZero() {
+		conditions = append(conditions, "time < ?")
+		args = append(args, f.Until)
+	}
+
+	query := "select id, time, actor, action, targetType, target, status, result, error from audit_log"
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	query += " order by id desc limit ?"
+	args = append(args, f.Limit)
+
+	rows, err := r.db.Query(r.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		err = rows.Scan(&e.Id, &e.Time, &e.Actor, &e.Action, &e.TargetType, &e.Target, &e.Status, &e.Result, &e.Error)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+//AppendEvent stores an event of a pi and drops the oldest events of that pi beyond keep
+func (r *inventoryRepo) AppendEvent(e piEvent, keep int) error {
+	_, err := r.stmts["appendEvent"].Exec(e.PiId, e.Time, e.Type, e.Detail)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.stmts["pruneEvents"].Exec(e.PiId, e.PiId, keep)
+	return err
+}
+
+//ListEvents returns the last limit events of a pi, oldest first
+func (r *inventoryRepo) ListEvents(piId string, limit int) ([]piEvent, error) {
+	rows, err := r.stmts["listEvents"].Query(piId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []piEvent{}
+	for rows.Next() {
+		var e piEvent
+		err = rows.Scan(&e.Id, &e.PiId, &e.Time, &e.Type, &e.Detail)
+		if err != nil {
+			return nil, err
+		}
+		events = append([]piEvent{e}, events...)
+	}
+
+	return events, rows.Err()
+}
+
+//PendingTask reports if a one time task, queued by a migration, still has to run
+func (r *inventoryRepo) PendingTask(name string) (bool, error) {
+	var count int
+	err := r.stmts["pendingTask"].QueryRow(name).Scan(&count)
+	return count > 0, err
+}
+
+//FinishTask marks a one time task as done
+func (r *inventoryRepo) FinishTask(name string) error {
+	_, err := r.stmts["finishTask"].Exec(name)
+	return err
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//testInventories are the databases the inventory tests run against. PostgreSQL needs a database to test in, set TEST_POSTGRES_DSN to a postgres:// URL.
+var testInventories = []struct {
+	name string
+	dsn  func(t *testing.T) string
+}{
+	{"sqlite", func(t *testing.T) string {
+		return path.Join(t.TempDir(), "inventory.db")
+	}},
+	{"postgres", func(t *testing.T) string {
+		dsn := os.Getenv("TEST_POSTGRES_DSN")
+		if dsn == "" {
+			t.Skip("TEST_POSTGRES_DSN is not set")
+		}
+
+		//every test gets a schema of its own, so tests start from an empty inventory
+		schema := "bakery_test_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+		db := openTestDb(t, dsn)
+		_, err := db.Exec("create schema " + schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Exec("drop schema " + schema + " cascade") })
+
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		return dsn + separator + "search_path=" + schema
+	}},
+}
+
+//forEachInventory runs a test against every database in testInventories
+func forEachInventory(t *testing.T, test func(t *testing.T, dsn string)) {
+	for _, inventory := range testInventories {
+		t.Run(inventory.name, func(t *testing.T) {
+			test(t, inventory.dsn(t))
+		})
+	}
+}
+
+func openTestDb(t *testing.T, dsn string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open(dialectFor(dsn).driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func openTestInventory(t *testing.T, dsn string) *inventoryRepo {
+	t.Helper()
+
+	store, err := openInventory(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := store.(*inventoryRepo)
+	t.Cleanup(func() { repo.db.Close() })
+
+	return repo
+}
+
+func TestMigrateEmptyInventory(t *testing.T) {
+	forEachInventory(t, func(t *testing.T, dsn string) {
+		openTestInventory(t, dsn)
+
+		//opening it again finds every migration applied
+		repo := openTestInventory(t, dsn)
+
+		rows, err := repo.db.Query("select version, name from schema_migrations order by version")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		var applied []string
+		for rows.Next() {
+			var version int
+			var name string
+			err = rows.Scan(&version, &name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			applied = append(applied, fmt.Sprintf("%v %v", version, name))
+		}
+
+		expected := []string{"1 inventory", "2 disks", "3 audit", "4 events"}
+		if !reflect.DeepEqual(applied, expected) {
+			t.Errorf("applied migrations %v, want %v", applied, expected)
+		}
+	})
+}
+
+func TestMigrateLegacyInventory(t *testing.T) {
+	forEachInventory(t, func(t *testing.T, dsn string) {
+		//the inventory as bakery kept it before migrations, with the disks of a pi in a comma separated column
+		db := openTestDb(t, dsn)
+		d := dialectFor(dsn)
+		_, err := db.Exec("create table inventory (id text not null primary key, status integer, bakeform text, diskIds text);")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(d.rebind("insert into inventory(id, status, bakeform, diskIds) values(?, ?, ?, ?), (?, ?, ?, ?)"),
+			"pi1", int(INUSE), "raspbian", "root1,data1", "pi2", int(NOTINUSE), "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repo := openTestInventory(t, dsn)
+
+		pi, err := repo.GetPi("pi1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := piRecord{Id: "pi1", Status: INUSE, Bakeform: "raspbian", DiskIds: []string{"root1", "data1"}}
+		if !reflect.DeepEqual(pi, expected) {
+			t.Errorf("migrated pi is %+v, want %+v", pi, expected)
+		}
+
+		pi, err = repo.GetPi("pi2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pi.DiskIds) != 0 {
+			t.Errorf("pi without disks got disks %v", pi.DiskIds)
+		}
+
+		//the folders of the old inventory are adopted once
+		pending, err := repo.PendingTask(taskAdoptDiskFolders)
+		if err != nil || !pending {
+			t.Errorf("adopting disk folders is not pending after the migration: %v", err)
+		}
+		err = repo.FinishTask(taskAdoptDiskFolders)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//the disks are moved to pi_disks once, saving the pi replaces them
+		err = repo.SavePi(piRecord{Id: "pi1", Status: INUSE, Bakeform: "raspbian", DiskIds: []string{"root1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo = openTestInventory(t, dsn)
+		pi, err = repo.GetPi("pi1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pi.DiskIds, []string{"root1"}) {
+			t.Errorf("disks after reopening are %v", pi.DiskIds)
+		}
+		if pending, _ := repo.PendingTask(taskAdoptDiskFolders); pending {
+			t.Error("adopting disk folders is pending again after reopening")
+		}
+	})
+}
+
+func TestSavePi(t *testing.T) {
+	forEachInventory(t, func(t *testing.T, dsn string) {
+		repo := openTestInventory(t, dsn)
+
+		first := piRecord{Id: "pi1", Status: PREPARING, Bakeform: "raspbian", DiskIds: []string{"root1"}}
+		second := piRecord{
+			Id:            "pi1",
+			Status:        INUSE,
+			Bakeform:      "raspbian",
+			Hostname:      "kitchen",
+			Labels:        `{"room":"kitchen"}`,
+			KernelArgs:    "quiet",
+			BootConfig:    "gpu_mem=16",
+			Address:       "10.0.0.9",
+			AddressPinned: true,
+			DiskIds:       []string{"root1", "", "data2"},
+		}
+
+		for _, p := range []piRecord{first, second} {
+			err := repo.SavePi(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pi, err := repo.GetPi("pi1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pi, second) {
+			t.Errorf("got %+v, want %+v", pi, second)
+		}
+
+		inUse, err := repo.ListPis(INUSE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inUse) != 1 || inUse[0].Id != "pi1" {
+			t.Errorf("pis in use are %+v", inUse)
+		}
+
+		_, err = repo.GetPi("pi2")
+		if err != sql.ErrNoRows {
+			t.Errorf("getting a missing pi returned %v", err)
+		}
+	})
+}
+
+func TestSaveAndDeleteDisk(t *testing.T) {
+	forEachInventory(t, func(t *testing.T, dsn string) {
+		repo := openTestInventory(t, dsn)
+
+		created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		disk := diskRecord{Id: "data1", Location: "/nfs/data1", CreatedAt: created, Owner: "alice", Quota: 1 << 30}
+		err := repo.SaveDisk(disk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//an update keeps the creation time
+		disk.Location = "/nfs/moved"
+		disk.Quota = 2 << 30
+		disk.CreatedAt = created.Add(time.Hour)
+		err = repo.SaveDisk(disk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		disks, err := repo.ListDisks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(disks) != 1 {
+			t.Fatalf("got %v disks, want 1", len(disks))
+		}
+		if disks[0].Location != "/nfs/moved" || disks[0].Quota != 2<<30 || !disks[0].CreatedAt.Equal(created) {
+			t.Errorf("got %+v", disks[0])
+		}
+
+		got, err := repo.GetDisk("data1")
+		if err != nil || got.Location != "/nfs/moved" || got.Owner != "alice" {
+			t.Errorf("got %+v, %v", got, err)
+		}
+
+		err = repo.SavePi(piRecord{Id: "pi1", Status: INUSE, DiskIds: []string{"root1", "data1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo.DeleteDisk("data1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		disks, err = repo.ListDisks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(disks) != 0 {
+			t.Errorf("deleted disk is still listed: %+v", disks)
+		}
+		_, err = repo.GetDisk("data1")
+		if err != sql.ErrNoRows {
+			t.Errorf("getting a deleted disk returned %v", err)
+		}
+
+		pi, err := repo.GetPi("pi1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pi.DiskIds, []string{"root1"}) {
+			t.Errorf("deleted disk is still attached: %v", pi.DiskIds)
+		}
+	})
+}
+
+func TestClaimPi(t *testing.T) {
+	forEachInventory(t, func(t *testing.T, dsn string) {
+		repo := openTestInventory(t, dsn)
+
+		err := repo.SavePi(piRecord{Id: "pi1", Status: NOTINUSE})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//two bakeries picked the same pi from the fridge
+		first, err := repo.ClaimPi("pi1", NOTINUSE, PREPARING)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := repo.ClaimPi("pi1", NOTINUSE, PREPARING)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !first || second {
+			t.Errorf("claims returned %v and %v, want only the first to win", first, second)
+		}
+
+		pi, err := repo.GetPi("pi1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pi.Status != PREPARING {
+			t.Errorf("status is %v", pi.Status)
+		}
+	})
+}
+
+func TestPruneEvents(t *testing.T) {
+	forEachInventory(t, func(t *testing.T, dsn string) {
+		repo := openTestInventory(t, dsn)
+
+		start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		for i := 0; i < 5; i++ {
+			for _, piId := range []string{"pi1", "pi2"} {
+				err := repo.AppendEvent(piEvent{PiId: piId, Time: start.Add(time.Duration(i) * time.Minute), Type: "boot", Detail: fmt.Sprint(i)}, 3)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		for _, piId := range []string{"pi1", "pi2"} {
+			events, err := repo.ListEvents(piId, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var details []string
+			for _, e := range events {
+				if e.PiId != piId {
+					t.Errorf("events of %v include an event of %v", piId, e.PiId)
+				}
+				details = append(details, e.Detail)
+			}
+			if !reflect.DeepEqual(details, []string{"2", "3", "4"}) {
+				t.Errorf("%v kept events %v, want the last 3, oldest first", piId, details)
+			}
+		}
+
+		events, err := repo.ListEvents("pi1", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || events[0].Detail != "3" || events[1].Detail != "4" {
+			t.Errorf("the last 2 events are %+v", events)
+		}
+	})
+}
+
+func TestListAudit(t *testing.T) {
+	forEachInventory(t, func(t *testing.T, dsn string) {
+		repo := openTestInventory(t, dsn)
+
+		start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		entries := []auditEntry{
+			{Actor: "alice", Action: "bake", TargetType: "pi", Target: "pi1", Status: 200, Result: "success"},
+			{Actor: "bob", Action: "unbake", TargetType: "pi", Target: "pi1", Status: 200, Result: "success"},
+			{Actor: "alice", Action: "createDisk", TargetType: "disk", Target: "data1", Status: 500, Result: "failure", Error: "disk full"},
+			{Actor: "bob", Action: "bake", TargetType: "pi", Target: "pi2", Status: 409, Result: "failure", Error: "pi is in use"},
+		}
+		for i, e := range entries {
+			e.Time = start.Add(time.Duration(i) * time.Hour)
+			err := repo.AppendAudit(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, test := range []struct {
+			name    string
+			filter  auditFilter
+			targets []string //actor/action of the expected entries, newest first
+		}{
+			{"all", auditFilter{Limit: 10}, []string{"bob/bake", "alice/createDisk", "bob/unbake", "alice/bake"}},
+			{"limit", auditFilter{Limit: 2}, []string{"bob/bake", "alice/createDisk"}},
+			{"actor", auditFilter{Actor: "alice", Limit: 10}, []string{"alice/createDisk", "alice/bake"}},
+			{"action", auditFilter{Action: "bake", Limit: 10}, []string{"bob/bake", "alice/bake"}},
+			{"target", auditFilter{TargetType: "pi", Target: "pi1", Limit: 10}, []string{"bob/unbake", "alice/bake"}},
+			{"result", auditFilter{Result: "failure", Limit: 10}, []string{"bob/bake", "alice/createDisk"}},
+			{"since", auditFilter{Since: start.Add(2 * time.Hour), Limit: 10}, []string{"bob/bake", "alice/createDisk"}},
+			{"until", auditFilter{Until: start.Add(time.Hour), Limit: 10}, []string{"alice/bake"}},
+			{"combined", auditFilter{Actor: "bob", Result: "success", Since: start, Until: start.Add(3 * time.Hour), Limit: 10}, []string{"bob/unbake"}},
+			{"nothing", auditFilter{Actor: "carol", Limit: 10}, nil},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				found, err := repo.ListAudit(test.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var targets []string
+				for _, e := range found {
+					targets = append(targets, e.Actor+"/"+e.Action)
+				}
+				if !reflect.DeepEqual(targets, test.targets) {
+					t.Errorf("got %v, want %v", targets, test.targets)
+				}
+			})
+		}
+
+		found, err := repo.ListAudit(auditFilter{Action: "createDisk", Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || found[0].Error != "disk full" || found[0].Status != 500 || !found[0].Time.Equal(start.Add(2*time.Hour)) {
+			t.Errorf("stored entry came back as %+v", found)
+		}
+	})
+}
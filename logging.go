@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+//setupLogging sends all logging, including the standard log package, through slog. format is text or json, level one of debug, info, warn or error.
+func setupLogging(format, level string) error {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if level != "" && err != nil {
+		return fmt.Errorf("Invalid LOG_LEVEL %v", level)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("Invalid LOG_FORMAT %v, should be text or json", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+type loggerContextKey struct{}
+
+//withRequestId starts a flow with its own request id. Everything logged with the logger of the returned context carries the id.
+func withRequestId(ctx context.Context, requestId string) context.Context {
+	if requestId == "" {
+		requestId = uuid.New().String()
+	}
+	return withLogger(ctx, slog.Default().With("requestId", requestId))
+}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+//loggerFrom returns the logger of a flow, or the default logger when the context has none
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+//requestIds is mux middleware that gives every API request an id, taken from X-Request-Id if the client sent one, and echoes it in the response
+func requestIds(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get("X-Request-Id")
+		if requestId == "" || len(requestId) > 128 {
+			requestId = uuid.New().String()
+		}
+
+		w.Header().Set("X-Request-Id", requestId)
+		next.ServeHTTP(w, r.WithContext(withRequestId(r.Context(), requestId)))
+	})
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
@@ -15,10 +21,41 @@ func main() {
 
 	bakeryRoot := os.Getenv("BAKERY_ROOT")
 	nfsServer := os.Getenv("NFS_ADDRESS")
-	inventoryDbPath := os.Getenv("DB_PATH")
+	inventoryDbPath := os.Getenv("DB_PATH") //a sqlite file or a postgres:// URL
 	ppiPath := os.Getenv("PPI_PATH")
 	ppiConfigPath := os.Getenv("PPI_CONFIG_PATH")
 	kpartxPath := os.Getenv("KPARTX_PATH")
+	hostnamePattern := os.Getenv("HOSTNAME_PATTERN")
+	bootTemplates := os.Getenv("BOOT_TEMPLATES")
+	tftpAddress := os.Getenv("TFTP_ADDRESS")
+	proxyDhcpInterface := os.Getenv("PROXYDHCP_INTERFACE")
+	proxyDhcpTftpServer := os.Getenv("PROXYDHCP_TFTP_SERVER")
+	bootImageSigningKey := os.Getenv("BOOT_IMAGE_SIGNING_KEY")
+	rootDiskMode := os.Getenv("ROOT_DISK_MODE")
+	blockRootSize := os.Getenv("BLOCK_ROOT_SIZE")
+	nbdAddress := os.Getenv("NBD_ADDRESS")
+	nfsVersion := os.Getenv("NFS_VERSION")
+	nfsExportFallback := os.Getenv("NFS_EXPORT_FALLBACK")
+	nfsExportsFile := os.Getenv("NFS_EXPORTS_FILE")
+	nfsExportsDryRun := os.Getenv("NFS_EXPORTS_DRYRUN") == "true"
+	embeddedNfs := os.Getenv("NFS_SERVER") == "embedded"
+	embeddedNfsAddress := os.Getenv("NFS_EMBEDDED_ADDRESS")
+	webhookUrls := os.Getenv("WEBHOOK_URLS") //comma separated
+	webhookSecret := os.Getenv("WEBHOOK_SECRET")
+	callbackHosts := os.Getenv("WEBHOOK_CALLBACK_HOSTS") //comma separated, any host when empty
+	logFormat := os.Getenv("LOG_FORMAT")                 //text or json
+	logLevel := os.Getenv("LOG_LEVEL")
+
+	err := setupLogging(logFormat, logLevel)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer shutdownTracing(context.Background())
 
 	if bakeryRoot == "" {
 		log.Fatalln("BAKERY_ROOT env var not set")
@@ -40,69 +77,206 @@ func main() {
 		log.Fatalln("KPARTX_PATH env var not set")
 	}
 
+	if hostnamePattern == "" {
+		hostnamePattern = "pi-{{.PiId}}"
+	}
+
+	if nbdAddress == "" && rootDiskMode == string(blockDisk) {
+		nbdAddress = ":10809"
+	}
+
+	blockRootSizeMB := 8192
+	if blockRootSize != "" {
+		size, err := strconv.Atoi(blockRootSize)
+		if err != nil || size <= 0 {
+			log.Fatalln("BLOCK_ROOT_SIZE should be a size in MB")
+		}
+		blockRootSizeMB = size
+	}
+
+	if bootTemplates == "" {
+		bootTemplates = "cmdline.txt"
+	}
+
 	nfsRoot := path.Join(bakeryRoot, "/nfs/")
 	imageFolder := path.Join(bakeryRoot, "/bakeforms/")
 	bootFolder := path.Join(bakeryRoot, "/boot/")
 	mountRoot := path.Join(bakeryRoot, "/mnt")
+	overrideRoot := path.Join(bakeryRoot, "/overrides")
+	httpBootRoot := path.Join(bakeryRoot, "/httpboot")
+	snapshotRoot := path.Join(bakeryRoot, "/snapshots")
 
-	initFolders(nfsRoot, imageFolder, bootFolder, mountRoot)
+	initFolders(nfsRoot, imageFolder, bootFolder, mountRoot, overrideRoot, path.Join(overrideRoot, "/pis"), path.Join(overrideRoot, "/bakeforms"), httpBootRoot, snapshotRoot)
+
+	//the embedded NFS server shares the folders itself, the kernel exports are left alone
+	var exporter *nfsExporter
+	if !embeddedNfs {
+		var err error
+		exporter, err = newNfsExporter(nfsExportsFile, nfsExportsDryRun)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		defer exporter.Close()
+
+		err = exporter.CleanLegacyExports(nfsRoot)
+		if err != nil {
+			log.Printf("Unable to clean up /etc/exports: %v\n", err)
+		}
+	}
 
-	fb, err := newFileBackend(nfsServer, nfsRoot, bootFolder)
+	fb, err := newFileBackend(nfsServer, nfsRoot, bootFolder, nfsVersion, nfsExportFallback, exporter)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
 
-	diskmgr, err := NewDiskManager(fb)
+	if embeddedNfs {
+		if embeddedNfsAddress == "" {
+			embeddedNfsAddress = ":2049"
+		}
+		nfsd, err := fb.EnableEmbeddedNfs(embeddedNfsAddress)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		go func() {
+			log.Fatalln(nfsd.ListenAndServe())
+		}()
+	}
 
-	bakeforms, err := newBakeformInventory(imageFolder, mountRoot, fb, kpartxPath)
+	inventory, err := openInventory(inventoryDbPath)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	diskmgr, err := NewDiskManager(inventory, fb, snapshotRoot, rootDiskMode, blockRootSizeMB)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	go diskmgr.WatchUsage(5 * time.Minute)
+
+	if nbdAddress != "" {
+		nbd, err := diskmgr.EnableNbd(nbdAddress)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		go func() {
+			log.Fatalln(nbd.ListenAndServe())
+		}()
+	}
+
+	bus := newEventBus()
+	bakeforms, err := newBakeformInventory(imageFolder, mountRoot, fb, kpartxPath, bus)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
 	defer bakeforms.UnmountAll()
 
-	pile, err := NewPiManager(bakeforms, diskmgr, inventoryDbPath, ppiPath, ppiConfigPath)
+	events := newEventLog(inventory, bus, 1000)
+	webhooks, err := newWebhookNotifier(parseWebhookUrls(webhookUrls), webhookSecret, parseWebhookUrls(strings.ToLower(callbackHosts)))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	pile, err := NewPiManager(bakeforms, diskmgr, inventory, events, webhooks, ppiPath, ppiConfigPath, hostnamePattern)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
 
-	fs, err := newFileServer(fb, pile, diskmgr)
+	fs, err := newFileServer(fb, pile, diskmgr, overrideRoot, strings.Split(bootTemplates, ","), httpBootRoot, bootImageSigningKey)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
 
+	if tftpAddress != "" {
+		tftp := newTftpServer(tftpAddress, fs, fb)
+		go func() {
+			log.Fatalln(tftp.ListenAndServe())
+		}()
+	}
+
+	if proxyDhcpInterface != "" {
+		proxyDhcp, err := newProxyDhcpServer(proxyDhcpInterface, proxyDhcpTftpServer)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		go func() {
+			log.Fatalln(proxyDhcp.ListenAndServe())
+		}()
+	}
+
 	log.Println("Restoring power state")
 	pis, err := pile.ListOven()
 	for _, pi := range pis {
-		err = pi.PowerOn()
+		//server side mounts of attached data disks don't survive a restart
+		if len(pi.Disks) > 0 && pi.Disks[0] != nil {
+			root := pi.Disks[0]
+			for _, dsk := range pi.Disks {
+				if dsk == nil || dsk.ID == root.ID {
+					continue
+				}
+				err = diskmgr.SurfaceDisk(root, dsk)
+				if err != nil {
+					log.Printf("Could not restore disk %v of rPi with ID: %v. %v\n", dsk.ID, pi.Id, err)
+				}
+			}
+		}
+
+		err = pi.PowerOn(context.Background())
 		if err != nil {
 			log.Printf("Could not restore power state of rPi with ID: %v. %v\n", pi.Id, err)
 		}
 	}
 
+	audit := newAuditLog(inventory)
+
+	prometheus.MustRegister(newInventoryCollector(inventory, diskmgr))
+
 	r := mux.NewRouter()
-	r.Path("/api/v1/files/{piId}/{filename}").Methods(http.MethodGet).HandlerFunc(fs.fileHandler) //Generates files for net booting
+	r.Use(requestIds, traceRequests, httpMetrics)
+	r.Path("/metrics").Methods(http.MethodGet).Handler(promhttp.Handler())
+	r.Path("/api/v1/files/{piId}/{filename:.+}").Methods(http.MethodGet).HandlerFunc(fs.fileHandler) //Generates files for net booting
+
+	r.Path("/api/v1/httpboot/{piId}/boot.img").Methods(http.MethodGet).HandlerFunc(fs.bootImageHandler) //Boot image for pi 4 HTTP boot
+	r.Path("/api/v1/httpboot/{piId}/boot.sig").Methods(http.MethodGet).HandlerFunc(fs.bootSigHandler)
 
 	r.Path("/api/v1/fridge").Methods(http.MethodGet).HandlerFunc(pile.FridgeHandler)
-	r.Path("/api/v1/fridge").Methods(http.MethodPost).HandlerFunc(pile.BakeHandler)
+	r.Path("/api/v1/fridge/{piId}/events").Methods(http.MethodGet).HandlerFunc(pile.EventsHandler)
+	r.Path("/api/v1/fridge").Methods(http.MethodPost).HandlerFunc(audit.record("bake", "pi", pile.BakeHandler))
 
-	r.Path("/api/v1/oven/{piId}/powercycle").Methods(http.MethodPost).HandlerFunc(pile.RebootHandler)
-	r.Path("/api/v1/oven/{piId}/disks").Methods(http.MethodPost).HandlerFunc(pile.AttachDiskHandler)
-	r.Path("/api/v1/oven/{piId}/disks/{diskId}").Methods(http.MethodDelete).HandlerFunc(pile.DetachDiskHandler)
-	r.Path("/api/v1/oven/{piId}/upload/{filename}").Methods(http.MethodPost).HandlerFunc(pile.UploadHandler)
+	r.Path("/api/v1/oven/{piId}/powercycle").Methods(http.MethodPost).HandlerFunc(audit.record("powercycle", "pi", pile.RebootHandler))
+	r.Path("/api/v1/oven/{piId}/disks").Methods(http.MethodPost).HandlerFunc(audit.record("attachDisk", "pi", pile.AttachDiskHandler))
+	r.Path("/api/v1/oven/{piId}/disks/{diskId}").Methods(http.MethodDelete).HandlerFunc(audit.record("detachDisk", "pi", pile.DetachDiskHandler))
+	r.Path("/api/v1/oven/{piId}/bootconfig").Methods(http.MethodGet).HandlerFunc(pile.GetBootConfigHandler)
+	r.Path("/api/v1/oven/{piId}/bootconfig").Methods(http.MethodPut).HandlerFunc(audit.record("setBootConfig", "pi", pile.SetBootConfigHandler))
+	r.Path("/api/v1/oven/{piId}/address").Methods(http.MethodPut).HandlerFunc(audit.record("setAddress", "pi", pile.SetAddressHandler))
+	r.Path("/api/v1/oven/{piId}/capture").Methods(http.MethodPost).HandlerFunc(audit.record("capture", "pi", pile.CaptureHandler))
+	r.Path("/api/v1/oven/{piId}/capture").Methods(http.MethodGet).HandlerFunc(pile.GetCaptureHandler)
+	r.Path("/api/v1/oven/{piId}/events").Methods(http.MethodGet).HandlerFunc(pile.EventsHandler)
+	r.Path("/api/v1/oven/{piId}/upload/{filename}").Methods(http.MethodPost).HandlerFunc(audit.record("uploadFile", "pi", pile.UploadHandler))
 	r.Path("/api/v1/oven/{piId}/download/{filename}").Methods(http.MethodGet).HandlerFunc(pile.DownloadHandler)
 	r.Path("/api/v1/oven/{piId}").Methods(http.MethodGet).HandlerFunc(pile.GetPiHandler)
-	r.Path("/api/v1/oven/{piId}").Methods(http.MethodDelete).HandlerFunc(pile.UnbakeHandler)
+	r.Path("/api/v1/oven/{piId}").Methods(http.MethodDelete).HandlerFunc(audit.record("unbake", "pi", pile.UnbakeHandler))
 	r.Path("/api/v1/oven").Methods(http.MethodGet).HandlerFunc(pile.OvenHandler)
 
 	r.Path("/api/v1/bakeforms").Methods(http.MethodGet).HandlerFunc(bakeforms.ListHandler)
-	r.Path("/api/v1/bakeforms/{name}").Methods(http.MethodPost).HandlerFunc(bakeforms.UploadHandler)
-	r.Path("/api/v1/bakeforms/{name}").Methods(http.MethodDelete).HandlerFunc(bakeforms.DeleteHandler)
+	r.Path("/api/v1/bakeforms/{name}").Methods(http.MethodPost).HandlerFunc(audit.record("uploadBakeform", "bakeform", bakeforms.UploadHandler))
+	r.Path("/api/v1/bakeforms/{name}").Methods(http.MethodDelete).HandlerFunc(audit.record("deleteBakeform", "bakeform", bakeforms.DeleteHandler))
 
-	r.Path("/api/v1/disks/{diskId}").Methods(http.MethodDelete).HandlerFunc(diskmgr.destroyDiskHandler)
+	r.Path("/api/v1/disks/{diskId}/snapshots/{snapshotId}/restore").Methods(http.MethodPost).HandlerFunc(audit.record("restoreSnapshot", "disk", pile.RestoreSnapshotHandler))
+	r.Path("/api/v1/disks/{diskId}/snapshots/{snapshotId}").Methods(http.MethodDelete).HandlerFunc(audit.record("deleteSnapshot", "disk", diskmgr.deleteSnapshotHandler))
+	r.Path("/api/v1/disks/{diskId}/snapshots").Methods(http.MethodPost).HandlerFunc(audit.record("createSnapshot", "disk", diskmgr.createSnapshotHandler))
+	r.Path("/api/v1/disks/{diskId}/snapshots").Methods(http.MethodGet).HandlerFunc(diskmgr.listSnapshotsHandler)
+	r.Path("/api/v1/disks/{diskId}/clone").Methods(http.MethodPost).HandlerFunc(audit.record("cloneDisk", "disk", diskmgr.cloneDiskHandler))
+	r.Path("/api/v1/disks/{diskId}/quota").Methods(http.MethodPut).HandlerFunc(audit.record("setQuota", "disk", diskmgr.setQuotaHandler))
+	r.Path("/api/v1/disks/{diskId}").Methods(http.MethodDelete).HandlerFunc(audit.record("destroyDisk", "disk", diskmgr.destroyDiskHandler))
 	r.Path("/api/v1/disks/{diskId}").Methods(http.MethodGet).HandlerFunc(diskmgr.getDiskHandler)
-	r.Path("/api/v1/disks").Methods(http.MethodPost).HandlerFunc(diskmgr.createDiskHandler)
+	r.Path("/api/v1/disks/{diskId}").Methods(http.MethodPatch).HandlerFunc(audit.record("resizeDisk", "disk", diskmgr.resizeDiskHandler))
+	r.Path("/api/v1/disks").Methods(http.MethodPost).HandlerFunc(audit.record("createDisk", "disk", diskmgr.createDiskHandler))
 	r.Path("/api/v1/disks").Methods(http.MethodGet).HandlerFunc(diskmgr.listDisksHandler)
 
+	r.Path("/api/v1/events").Methods(http.MethodGet).HandlerFunc(bus.StreamHandler)
+	r.Path("/api/v1/audit").Methods(http.MethodGet).HandlerFunc(audit.ListHandler)
+
 	log.Println("Ready to bake!")
 	http.ListenAndServe(fmt.Sprintf(":%v", httpPort), r)
 
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	bakePhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bakery_bake_phase_duration_seconds",
+		Help:    "Time spent in each phase of baking a pi.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200},
+	}, []string{"phase"})
+
+	bakeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bakery_bake_duration_seconds",
+		Help:    "Time it took to bake a pi, from the fridge to ready or failed.",
+		Buckets: []float64{5, 15, 30, 60, 120, 300, 600, 1200, 2400},
+	}, []string{"result"})
+
+	ppiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bakery_ppi_duration_seconds",
+		Help:    "Latency of the power plugin per action.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"action"})
+
+	ppiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bakery_ppi_errors_total",
+		Help: "Failed calls to the power plugin per action.",
+	}, []string{"action"})
+
+	bootFileRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bakery_boot_file_requests_total",
+		Help: "Boot file requests by pis. Only served files are counted per filename, so unknown names can't blow up the number of series.",
+	}, []string{"filename", "result"})
+
+	nfsExportRegenDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bakery_nfs_export_regen_duration_seconds",
+		Help:    "Time it took to regenerate and apply the NFS exports.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bakery_http_requests_total",
+		Help: "API requests per route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bakery_http_request_duration_seconds",
+		Help:    "API request latency per route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+//inventoryCollector reports the pis and disks in the inventory when metrics are scraped, so the numbers are never stale
+type inventoryCollector struct {
+	store inventoryStore
+	dm    *diskManager
+
+	pis       *prometheus.Desc
+	disks     *prometheus.Desc
+	diskUsed  *prometheus.Desc
+	diskSize  *prometheus.Desc
+	diskQuota *prometheus.Desc
+}
+
+func newInventoryCollector(store inventoryStore, dm *diskManager) *inventoryCollector {
+	return &inventoryCollector{
+		store:     store,
+		dm:        dm,
+		pis:       prometheus.NewDesc("bakery_pis", "Pis in the inventory per state.", []string{"state"}, nil),
+		disks:     prometheus.NewDesc("bakery_disks", "Disks per mode.", []string{"mode"}, nil),
+		diskUsed:  prometheus.NewDesc("bakery_disks_used_bytes", "Space taken by the disks on the server per mode.", []string{"mode"}, nil),
+		diskSize:  prometheus.NewDesc("bakery_disks_size_bytes", "Provisioned size of the disks per mode.", []string{"mode"}, nil),
+		diskQuota: prometheus.NewDesc("bakery_disks_quota_bytes", "Sum of the quotas of the NFS disks.", []string{"mode"}, nil),
+	}
+}
+
+func (c *inventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.pis
+	ch <- c.disks
+	ch <- c.diskUsed
+	ch <- c.diskSize
+	ch <- c.diskQuota
+}
+
+func (c *inventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	for state, status := range map[string]piStatus{"fridge": NOTINUSE, "oven": INUSE, "preparing": PREPARING} {
+		pis, err := c.store.ListPis(status)
+		if err != nil {
+			log.Printf("Unable to count %v pis for metrics: %v\n", state, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.pis, prometheus.GaugeValue, float64(len(pis)), state)
+	}
+
+	counts := map[diskMode]float64{nfsDisk: 0, blockDisk: 0}
+	used := map[diskMode]float64{nfsDisk: 0, blockDisk: 0}
+	size := map[diskMode]float64{nfsDisk: 0, blockDisk: 0}
+	quota := map[diskMode]float64{nfsDisk: 0, blockDisk: 0}
+
+	disks := c.dm.ListDisks()
+	c.dm.disksMutex.RLock()
+	for _, dsk := range disks {
+		counts[dsk.Mode]++
+		used[dsk.Mode] += float64(dsk.Used * 1024 * 1024)
+		size[dsk.Mode] += float64(dsk.Size * 1024 * 1024)
+		quota[dsk.Mode] += float64(dsk.Quota * 1024 * 1024)
+	}
+	c.dm.disksMutex.RUnlock()
+
+	for mode := range counts {
+		ch <- prometheus.MustNewConstMetric(c.disks, prometheus.GaugeValue, counts[mode], string(mode))
+		ch <- prometheus.MustNewConstMetric(c.diskUsed, prometheus.GaugeValue, used[mode], string(mode))
+		ch <- prometheus.MustNewConstMetric(c.diskSize, prometheus.GaugeValue, size[mode], string(mode))
+		ch <- prometheus.MustNewConstMetric(c.diskQuota, prometheus.GaugeValue, quota[mode], string(mode))
+	}
+}
+
+//metricsRecorder keeps the status code of a response. Flushing is passed through for the event stream.
+type metricsRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (m *metricsRecorder) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *metricsRecorder) Write(b []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	return m.ResponseWriter.Write(b)
+}
+
+func (m *metricsRecorder) Flush() {
+	if flusher, ok := m.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//httpMetrics is mux middleware that counts and times requests per route template, not per url, so pi and disk ids don't become labels
+func httpMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		recorder := &metricsRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+//migration is a numbered change to the inventory schema. Migrations run once, in order, each in its own transaction.
+//Never change a migration that has been released, add a new one instead.
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *sql.Tx, d sqlDialect) error
+}
+
+var migrations = []migration{
+	{1, "inventory", migrateInventory},
+	{2, "disks", migrateDisks},
+	{3, "audit", migrateAudit},
+	{4, "events", migrateEvents},
+}
+
+//migrate brings the schema of the inventory up to date. Instances sharing an inventory take turns, a migration applied by another instance is skipped.
+func migrate(db *sql.DB, d sqlDialect) error {
+	_, err := db.Exec("create table if not exists schema_migrations (version integer not null primary key, name text not null, appliedAt timestamp not null);")
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = db.QueryRow("select coalesce(max(version), 0) from schema_migrations").Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		applied, err := migrationApplied(tx, d, m.version)
+		if err != nil || applied {
+			tx.Rollback()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		log.Printf("Migrating %v inventory to version %v (%v)\n", d.name, m.version, m.name)
+		err = m.apply(tx, d)
+		if err == nil {
+			_, err = tx.Exec(d.rebind("insert into schema_migrations(version, name, appliedAt) values(?, ?, ?)"), m.version, m.name, time.Now().UTC())
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %v (%v) failed: %v", m.version, m.name, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//migrationApplied takes the migration lock and checks if another instance applied the migration in the meantime
+func migrationApplied(tx *sql.Tx, d sqlDialect, version int) (bool, error) {
+	if d.migrationLock != "" {
+		_, err := tx.Exec(d.migrationLock)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var count int
+	err := tx.QueryRow(d.rebind("select count(*) from schema_migrations where version = ?"), version).Scan(&count)
+	return count > 0, err
+}
+
+//migrateInventory creates the pi inventory. Inventories of older versions of bakery already have the table, but lack the newer columns.
+func migrateInventory(tx *sql.Tx, d sqlDialect) error {
+	_, err := tx.Exec("create table if not exists inventory (id text not null primary key, status integer, bakeform text, diskIds text);")
+	if err != nil {
+		return err
+	}
+
+	for _, column := range []string{"hostname", "labels", "kernelArgs", "bootConfig", "address"} {
+		err = d.addColumn(tx, "inventory", column, "text not null default ''")
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.addColumn(tx, "inventory", "addressPinned", d.boolType)
+}
+
+//migrateDisks creates the disk inventory and moves the comma separated diskIds of the pis into pi_disks.
+//Older versions of bakery had no disk inventory, every folder in the NFS root was a disk. Those folders are adopted once, on the next start.
+func migrateDisks(tx *sql.Tx, d sqlDialect) error {
+	var hasDisks int
+	err := tx.QueryRow(d.rebind(d.tableExists), "disks").Scan(&hasDisks)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("create table if not exists disks (id text not null primary key, location text not null, createdAt timestamp not null, sourceBakeform text not null default '', owner text not null default '', quota integer not null default 0);")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("create table if not exists inventory_tasks (name text not null primary key);")
+	if err != nil {
+		return err
+	}
+	if hasDisks == 0 {
+		_, err = tx.Exec(d.rebind("insert into inventory_tasks(name) values(?) on conflict do nothing"), taskAdoptDiskFolders)
+		if err != nil {
+			return err
+		}
+	}
+
+	var hasPiDisks int
+	err = tx.QueryRow(d.rebind(d.tableExists), "pi_disks").Scan(&hasPiDisks)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("create table if not exists pi_disks (piId text not null, diskId text not null, position integer not null, primary key (piId, diskId));")
+	if err != nil || hasPiDisks > 0 {
+		return err
+	}
+
+	rows, err := tx.Query("select id, diskIds from inventory where diskIds != ''")
+	if err != nil {
+		return err
+	}
+
+	attached := make(map[string][]string)
+	for rows.Next() {
+		var piId, diskIds string
+		err = rows.Scan(&piId, &diskIds)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		attached[piId] = strings.Split(diskIds, ",")
+	}
+	rows.Close()
+
+	for piId, diskIds := range attached {
+		for position, diskId := range diskIds {
+			_, err = tx.Exec(d.rebind("insert into pi_disks(piId, diskId, position) values(?, ?, ?) on conflict do nothing"), piId, diskId, position)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//migrateAudit creates the audit log. Rows are only ever inserted.
+func migrateAudit(tx *sql.Tx, d sqlDialect) error {
+	_, err := tx.Exec(fmt.Sprintf("create table if not exists audit_log (id %v, time timestamp not null, actor text not null, action text not null, targetType text not null, target text not null, status integer not null, result text not null, error text not null);", d.autoIncrement))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("create index if not exists audit_log_target on audit_log(targetType, target);")
+	return err
+}
+
+//migrateEvents creates the event history of the pis
+func migrateEvents(tx *sql.Tx, d sqlDialect) error {
+	_, err := tx.Exec(fmt.Sprintf("create table if not exists pi_events (id %v, piId text not null, time timestamp not null, type text not null, detail text not null);", d.autoIncrement))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("create index if not exists pi_events_pi on pi_events(piId, id);")
+	return err
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+//NBD protocol constants (https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md)
+const (
+	nbdMagic        uint64 = 0x4e42444d41474943 //"NBDMAGIC"
+	nbdOptMagic     uint64 = 0x49484156454f5054 //"IHAVEOPT"
+	nbdRepMagic     uint64 = 0x3e889045565a9
+	nbdRequestMagic uint32 = 0x25609513
+	nbdReplyMagic   uint32 = 0x67446698
+
+	nbdFlagFixedNewstyle uint16 = 1 << 0
+	nbdFlagNoZeroes      uint16 = 1 << 1
+
+	nbdFlagHasFlags  uint16 = 1 << 0
+	nbdFlagSendFlush uint16 = 1 << 2
+	nbdFlagSendFua   uint16 = 1 << 3
+
+	nbdOptExportName uint32 = 1
+	nbdOptAbort      uint32 = 2
+	nbdOptList       uint32 = 3
+	nbdOptInfo       uint32 = 6
+	nbdOptGo         uint32 = 7
+
+	nbdRepAck        uint32 = 1
+	nbdRepInfo       uint32 = 3
+	nbdRepErrUnsup   uint32 = 1<<31 + 1
+	nbdRepErrInvalid uint32 = 1<<31 + 3
+	nbdRepErrUnknown uint32 = 1<<31 + 6
+
+	nbdInfoExport uint16 = 0
+
+	nbdCmdRead    uint16 = 0
+	nbdCmdWrite   uint16 = 1
+	nbdCmdDisc    uint16 = 2
+	nbdCmdFlush   uint16 = 3
+	nbdCmdFlagFua uint16 = 1 << 0
+
+	nbdEIO    uint32 = 5
+	nbdEINVAL uint32 = 22
+	nbdENOSPC uint32 = 28
+
+	nbdMaxRequestSize = 32 * 1024 * 1024
+)
+
+const nbdTransmissionFlags = nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendFua
+
+//nbdExports resolves export names to the image files behind them. An export is only opened for the client it belongs to.
+type nbdExports interface {
+	openExport(name, client string) (*os.File, error)
+	closeExport(name string)
+}
+
+//nbdServer exports disk images over the NBD protocol (fixed newstyle handshake) so pis can use them as block devices
+type nbdServer struct {
+	address string
+	exports nbdExports
+	mutex   *sync.Mutex
+	clients map[string][]net.Conn
+}
+
+func newNbdServer(address string, exports nbdExports) *nbdServer {
+	return &nbdServer{
+		address: address,
+		exports: exports,
+		mutex:   &sync.Mutex{},
+		clients: make(map[string][]net.Conn),
+	}
+}
+
+func (s *nbdServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("NBD server listening on %v\n", listener.Addr())
+	return s.serve(listener)
+}
+
+func (s *nbdServer) serve(listener net.Listener) error {
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			err := s.handleConn(conn)
+			if err != nil && err != io.EOF {
+				log.Printf("NBD: connection from %v closed: %v\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+//Disconnect closes all client connections to an export
+func (s *nbdServer) Disconnect(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, conn := range s.clients[name] {
+		conn.Close()
+	}
+	delete(s.clients, name)
+}
+
+func (s *nbdServer) addClient(name string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.clients[name] = append(s.clients[name], conn)
+}
+
+func (s *nbdServer) removeClient(name string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, c := range s.clients[name] {
+		if c == conn {
+			s.clients[name] = append(s.clients[name][:i], s.clients[name][i+1:]...)
+			break
+		}
+	}
+	if len(s.clients[name]) == 0 {
+		delete(s.clients, name)
+	}
+}
+
+func (s *nbdServer) handleConn(conn net.Conn) error {
+	err := binary.Write(conn, binary.BigEndian, struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}{nbdMagic, nbdOptMagic, nbdFlagFixedNewstyle | nbdFlagNoZeroes})
+	if err != nil {
+		return err
+	}
+
+	var clientFlags uint32
+	err = binary.Read(conn, binary.BigEndian, &clientFlags)
+	if err != nil {
+		return err
+	}
+	noZeroes := uint16(clientFlags)&nbdFlagNoZeroes != 0
+
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+
+	name, file, size, err := s.negotiate(conn, client, noZeroes)
+	if err != nil || file == nil {
+		return err
+	}
+	defer s.close(name, file)
+
+	s.addClient(name, conn)
+	defer s.removeClient(name, conn)
+
+	log.Printf("NBD: %v connected to %v\n", conn.RemoteAddr(), name)
+	return s.transmit(conn, file, size)
+}
+
+//negotiate runs the option haggling phase until the client selects an export or aborts
+func (s *nbdServer) negotiate(conn net.Conn, client string, noZeroes bool) (string, *os.File, int64, error) {
+	for {
+		var opt struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		err := binary.Read(conn, binary.BigEndian, &opt)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		if opt.Magic != nbdOptMagic {
+			return "", nil, 0, fmt.Errorf("bad option magic")
+		}
+		if opt.Length > 4096 {
+			return "", nil, 0, fmt.Errorf("option too large")
+		}
+
+		data := make([]byte, opt.Length)
+		_, err = io.ReadFull(conn, data)
+		if err != nil {
+			return "", nil, 0, err
+		}
+
+		switch opt.Option {
+		case nbdOptExportName:
+			name := string(data)
+			file, size, err := s.open(name, client)
+			if err != nil {
+				//the old style option has no way to report errors, just hang up
+				return "", nil, 0, err
+			}
+
+			reply := make([]byte, 10, 134)
+			binary.BigEndian.PutUint64(reply, uint64(size))
+			binary.BigEndian.PutUint16(reply[8:], nbdTransmissionFlags)
+			if !noZeroes {
+				reply = append(reply, make([]byte, 124)...)
+			}
+			_, err = conn.Write(reply)
+			if err != nil {
+				s.close(name, file)
+				return "", nil, 0, err
+			}
+			return name, file, size, nil
+
+		case nbdOptInfo, nbdOptGo:
+			if len(data) < 6 || int(binary.BigEndian.Uint32(data)) > len(data)-6 {
+				err = s.optionReply(conn, opt.Option, nbdRepErrInvalid, nil)
+				if err != nil {
+					return "", nil, 0, err
+				}
+				continue
+			}
+			name := string(data[4 : 4+binary.BigEndian.Uint32(data)])
+
+			file, size, err := s.open(name, client)
+			if err != nil {
+				err = s.optionReply(conn, opt.Option, nbdRepErrUnknown, []byte(err.Error()))
+				if err != nil {
+					return "", nil, 0, err
+				}
+				continue
+			}
+
+			info := make([]byte, 12)
+			binary.BigEndian.PutUint16(info, nbdInfoExport)
+			binary.BigEndian.PutUint64(info[2:], uint64(size))
+			binary.BigEndian.PutUint16(info[10:], nbdTransmissionFlags)
+			err = s.optionReply(conn, opt.Option, nbdRepInfo, info)
+			if err == nil {
+				err = s.optionReply(conn, opt.Option, nbdRepAck, nil)
+			}
+			if err != nil || opt.Option == nbdOptInfo {
+				s.close(name, file)
+				if err != nil {
+					return "", nil, 0, err
+				}
+				continue
+			}
+			return name, file, size, nil
+
+		case nbdOptAbort:
+			s.optionReply(conn, opt.Option, nbdRepAck, nil)
+			return "", nil, 0, nil
+
+		case nbdOptList:
+			//exports are only handed out to clients that know their name
+			err = s.optionReply(conn, opt.Option, nbdRepAck, nil)
+
+		default:
+			err = s.optionReply(conn, opt.Option, nbdRepErrUnsup, nil)
+		}
+
+		if err != nil {
+			return "", nil, 0, err
+		}
+	}
+}
+
+func (s *nbdServer) open(name, client string) (*os.File, int64, error) {
+	file, err := s.exports.openExport(name, client)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		s.close(name, file)
+		return nil, 0, err
+	}
+
+	return file, fi.Size(), nil
+}
+
+//close closes an export that was opened with open
+func (s *nbdServer) close(name string, file *os.File) {
+	file.Close()
+	s.exports.closeExport(name)
+}
+
+func (s *nbdServer) optionReply(conn net.Conn, option, replyType uint32, data []byte) error {
+	reply := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint64(reply, nbdRepMagic)
+	binary.BigEndian.PutUint32(reply[8:], option)
+	binary.BigEndian.PutUint32(reply[12:], replyType)
+	binary.BigEndian.PutUint32(reply[16:], uint32(len(data)))
+	reply = append(reply, data...)
+
+	_, err := conn.Write(reply)
+	return err
+}
+
+//transmit handles block requests until the client disconnects. Requests must stay within the size the export was announced with.
+func (s *nbdServer) transmit(conn net.Conn, file *os.File, size int64) error {
+	header := make([]byte, 28)
+	buf := make([]byte, 128*1024)
+
+	for {
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			return err
+		}
+
+		if binary.BigEndian.Uint32(header) != nbdRequestMagic {
+			return fmt.Errorf("bad request magic")
+		}
+		flags := binary.BigEndian.Uint16(header[4:])
+		cmd := binary.BigEndian.Uint16(header[6:])
+		handle := header[8:16]
+		offset := int64(binary.BigEndian.Uint64(header[16:]))
+		length := binary.BigEndian.Uint32(header[24:])
+
+		if (cmd == nbdCmdRead || cmd == nbdCmdWrite) && length > nbdMaxRequestSize {
+			return fmt.Errorf("request of %v bytes too large", length)
+		}
+		inBounds := offset >= 0 && offset+int64(length) <= size
+
+		//only reads and writes carry data, the length of other commands is not used to size anything
+		var data []byte
+		var errno uint32
+		switch cmd {
+		case nbdCmdRead:
+			if !inBounds {
+				errno = nbdEINVAL
+				break
+			}
+			buf = growBuffer(buf, length)
+			data = buf[:length]
+			n, err := file.ReadAt(data, offset)
+			if err != nil && err != io.EOF {
+				errno = nbdEIO
+				data = nil
+			} else {
+				//past the end of the disk the client reads zeros, not what the previous request left in the buffer
+				clear(data[n:])
+			}
+
+		case nbdCmdWrite:
+			buf = growBuffer(buf, length)
+			_, err = io.ReadFull(conn, buf[:length])
+			if err != nil {
+				return err
+			}
+			//writing past the end would grow disk.img beyond the size of the disk
+			if !inBounds {
+				errno = nbdENOSPC
+				break
+			}
+			_, err = file.WriteAt(buf[:length], offset)
+			if err == nil && flags&nbdCmdFlagFua != 0 {
+				err = file.Sync()
+			}
+			if err != nil {
+				errno = nbdEIO
+				if errors.Is(err, syscall.ENOSPC) {
+					errno = nbdENOSPC
+				}
+			}
+
+		case nbdCmdFlush:
+			if file.Sync() != nil {
+				errno = nbdEIO
+			}
+
+		case nbdCmdDisc:
+			return file.Sync()
+
+		default:
+			errno = nbdEINVAL
+		}
+
+		reply := make([]byte, 16, 16+len(data))
+		binary.BigEndian.PutUint32(reply, nbdReplyMagic)
+		binary.BigEndian.PutUint32(reply[4:], errno)
+		copy(reply[8:], handle)
+		reply = append(reply, data...)
+
+		_, err = conn.Write(reply)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//growBuffer returns buf, or a new buffer if buf is smaller than length
+func growBuffer(buf []byte, length uint32) []byte {
+	if int(length) > len(buf) {
+		return make([]byte, length)
+	}
+	return buf
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+const testNbdDiskSize = 1024 * 1024
+
+//startTestNbdServer exports one block disk, disk1, to 127.0.0.1 from an NBD server on localhost
+func startTestNbdServer(t *testing.T) (*diskManager, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	store, err := openInventory(path.Join(dir, "inventory.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := newFileBackend("127.0.0.1", path.Join(dir, "nfs"), path.Join(dir, "boot"), "3", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm, err := NewDiskManager(store, fb, path.Join(dir, "snapshots"), "nfs", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location := path.Join(dir, "nfs", "disk1")
+	err = os.MkdirAll(location, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = createSparseFile(path.Join(location, "disk.img"), testNbdDiskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm.Disks["disk1"] = &disk{ID: "disk1", Location: location, Size: 1, Mode: blockDisk}
+
+	server, err := dm.EnableNbd("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.serve(listener)
+
+	err = dm.ExportTo(context.Background(), map[string][]string{"disk1": {"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dm, listener.Addr().String()
+}
+
+//connectTestNbd runs the fixed newstyle handshake and selects an export with NBD_OPT_GO. It returns the export size.
+func connectTestNbd(t *testing.T, address, name string) (net.Conn, uint64, error) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	greeting := make([]byte, 18)
+	_, err = io.ReadFull(conn, greeting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint64(greeting) != nbdMagic || binary.BigEndian.Uint64(greeting[8:]) != nbdOptMagic {
+		t.Fatalf("bad greeting %x", greeting)
+	}
+	binary.Write(conn, binary.BigEndian, uint32(nbdFlagFixedNewstyle|nbdFlagNoZeroes))
+
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+	data = append(data, name...)
+	data = binary.BigEndian.AppendUint16(data, 0)
+	option := binary.BigEndian.AppendUint64(nil, nbdOptMagic)
+	option = binary.BigEndian.AppendUint32(option, nbdOptGo)
+	option = binary.BigEndian.AppendUint32(option, uint32(len(data)))
+	conn.Write(append(option, data...))
+
+	var size uint64
+	for {
+		header := make([]byte, 20)
+		_, err = io.ReadFull(conn, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, binary.BigEndian.Uint32(header[16:]))
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch replyType := binary.BigEndian.Uint32(header[12:]); replyType {
+		case nbdRepInfo:
+			size = binary.BigEndian.Uint64(reply[2:])
+		case nbdRepAck:
+			return conn, size, nil
+		default:
+			return conn, 0, fmt.Errorf("export %v refused with %x: %s", name, replyType, reply)
+		}
+	}
+}
+
+//nbdRequest sends one block request and returns the error of the reply and, for reads, the data
+func nbdRequest(t *testing.T, conn net.Conn, cmd uint16, offset uint64, length uint32, data []byte) (uint32, []byte) {
+	t.Helper()
+
+	request := binary.BigEndian.AppendUint32(nil, nbdRequestMagic)
+	request = binary.BigEndian.AppendUint16(request, 0)
+	request = binary.BigEndian.AppendUint16(request, cmd)
+	request = binary.BigEndian.AppendUint64(request, 42)
+	request = binary.BigEndian.AppendUint64(request, offset)
+	request = binary.BigEndian.AppendUint32(request, length)
+	_, err := conn.Write(append(request, data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 16)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(reply) != nbdReplyMagic || binary.BigEndian.Uint64(reply[8:]) != 42 {
+		t.Fatalf("bad reply %x", reply)
+	}
+	errno := binary.BigEndian.Uint32(reply[4:])
+	if cmd != nbdCmdRead || errno != 0 {
+		return errno, nil
+	}
+
+	read := make([]byte, length)
+	_, err = io.ReadFull(conn, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return errno, read
+}
+
+func TestNbdReadsAndWritesTheDisk(t *testing.T) {
+	_, address := startTestNbdServer(t)
+
+	conn, size, err := connectTestNbd(t, address, "disk1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != testNbdDiskSize {
+		t.Errorf("export size is %v, want %v", size, testNbdDiskSize)
+	}
+
+	block := bytes.Repeat([]byte("pi"), 256)
+	errno, _ := nbdRequest(t, conn, nbdCmdWrite, 4096, uint32(len(block)), block)
+	if errno != 0 {
+		t.Fatalf("write failed with %v", errno)
+	}
+	errno, read := nbdRequest(t, conn, nbdCmdRead, 4096, uint32(len(block)), nil)
+	if errno != 0 || !bytes.Equal(read, block) {
+		t.Errorf("read back %q with error %v", read, errno)
+	}
+}
+
+func TestNbdRefusesRequestsPastTheEnd(t *testing.T) {
+	dm, address := startTestNbdServer(t)
+
+	conn, _, err := connectTestNbd(t, address, "disk1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errno, _ := nbdRequest(t, conn, nbdCmdRead, testNbdDiskSize-512, 1024, nil)
+	if errno != nbdEINVAL {
+		t.Errorf("read past the end failed with %v, want EINVAL", errno)
+	}
+
+	errno, _ = nbdRequest(t, conn, nbdCmdWrite, testNbdDiskSize, 512, make([]byte, 512))
+	if errno != nbdENOSPC {
+		t.Errorf("write past the end failed with %v, want ENOSPC", errno)
+	}
+
+	//the connection is still usable after a refused request
+	errno, _ = nbdRequest(t, conn, nbdCmdRead, 0, 512, nil)
+	if errno != 0 {
+		t.Errorf("read after a refused request failed with %v", errno)
+	}
+
+	fi, err := os.Stat(path.Join(dm.Disks["disk1"].Location, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != testNbdDiskSize {
+		t.Errorf("disk.img grew to %v bytes", fi.Size())
+	}
+}
+
+func TestNbdRefusesOtherClients(t *testing.T) {
+	dm, address := startTestNbdServer(t)
+	dm.ExportTo(context.Background(), map[string][]string{"disk1": {"10.0.0.9"}})
+
+	_, _, err := connectTestNbd(t, address, "disk1")
+	if err == nil {
+		t.Error("a client the disk is not exported to connected to it")
+	}
+}
+
+func TestNbdRefusesSecondConnection(t *testing.T) {
+	_, address := startTestNbdServer(t)
+
+	_, _, err := connectTestNbd(t, address, "disk1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = connectTestNbd(t, address, "disk1")
+	if err == nil {
+		t.Error("a second client connected to a disk that is in use")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+//nfsExporter owns a single exports file, by default /etc/exports.d/bakery.exports, so exports that are not bakery's are left alone.
+//In dry run mode the file is written to a temporary folder and exportfs is never called, no root needed.
+type nfsExporter struct {
+	exportsFile       string
+	legacyExportsFile string
+	exportfsPath      string
+	dryRun            bool
+	tmpDir            string
+}
+
+func newNfsExporter(exportsFile string, dryRun bool) (*nfsExporter, error) {
+	if exportsFile == "" {
+		exportsFile = "/etc/exports.d/bakery.exports"
+	}
+
+	tmpDir := ""
+	if dryRun {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "bakery-exports")
+		if err != nil {
+			return nil, err
+		}
+		exportsFile = path.Join(tmpDir, path.Base(exportsFile))
+		log.Printf("NFS exports dry run. Writing exports to %v\n", exportsFile)
+	}
+
+	err := os.MkdirAll(path.Dir(exportsFile), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nfsExporter{
+		exportsFile:       exportsFile,
+		legacyExportsFile: "/etc/exports",
+		exportfsPath:      "exportfs",
+		dryRun:            dryRun,
+		tmpDir:            tmpDir,
+	}, nil
+}
+
+//Close removes the temporary folder of a dry run
+func (e *nfsExporter) Close() error {
+	if e.tmpDir == "" {
+		return nil
+	}
+	return os.RemoveAll(e.tmpDir)
+}
+
+//Apply writes the exports and reloads the NFS server if anything changed.
+//If the NFS server can't be reloaded the previous exports file is put back, so the next Apply tries again.
+func (e *nfsExporter) Apply(ctx context.Context, content string) (bool, error) {
+	current, err := ioutil.ReadFile(e.exportsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if string(current) == content {
+		return false, nil
+	}
+
+	logger := loggerFrom(ctx)
+	added, removed := diffLines(string(current), content)
+	for _, line := range removed {
+		logger.Info("Unexporting", "export", line)
+	}
+	for _, line := range added {
+		logger.Info("Exporting", "export", line)
+	}
+
+	//write next to the target and rename, so exportfs never reads half a file
+	tmpFile := e.exportsFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, []byte(content), 0644)
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Rename(tmpFile, e.exportsFile)
+	if err != nil {
+		return false, err
+	}
+
+	if e.dryRun {
+		return true, nil
+	}
+
+	out, err := exec.Command(e.exportfsPath, "-ra").CombinedOutput()
+	if err != nil {
+		restoreErr := e.restore(current)
+		if restoreErr != nil {
+			logger.Error("Unable to put back the previous exports", "error", restoreErr)
+		}
+		return false, fmt.Errorf("exportfs failed: %v %v", err, string(out))
+	}
+
+	return true, nil
+}
+
+//restore puts back the exports file as it was before Apply. A file that didn't exist is removed.
+func (e *nfsExporter) restore(previous []byte) error {
+	if previous == nil {
+		err := os.Remove(e.exportsFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return ioutil.WriteFile(e.exportsFile, previous, 0644)
+}
+
+//CleanLegacyExports removes the folders under nfsRoot from /etc/exports. Older versions of bakery wrote them there.
+func (e *nfsExporter) CleanLegacyExports(nfsRoot string) error {
+	if e.dryRun {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(e.legacyExportsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var kept []string
+	removed := false
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, strings.TrimRight(nfsRoot, "/")+"/") {
+			removed = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	if !removed {
+		return nil
+	}
+
+	log.Println("Removing bakery folders from " + e.legacyExportsFile + ". They are managed in " + e.exportsFile + " now")
+	return ioutil.WriteFile(e.legacyExportsFile, []byte(strings.Join(kept, "\n")), 0644)
+}
+
+//diffLines returns the lines only in b and the lines only in a
+func diffLines(a, b string) ([]string, []string) {
+	inA := make(map[string]bool)
+	for _, line := range strings.Split(a, "\n") {
+		inA[line] = true
+	}
+
+	inB := make(map[string]bool)
+	var added []string
+	for _, line := range strings.Split(b, "\n") {
+		inB[line] = true
+		if line != "" && !inA[line] {
+			added = append(added, line)
+		}
+	}
+
+	var removed []string
+	for _, line := range strings.Split(a, "\n") {
+		if line != "" && !inB[line] {
+			removed = append(removed, line)
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func newTestExporter(t *testing.T) *nfsExporter {
+	t.Helper()
+	exporter, err := newNfsExporter("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { exporter.Close() })
+
+	return exporter
+}
+
+func TestDiffLines(t *testing.T) {
+	added, removed := diffLines("/nfs/a 10.0.0.1(rw)\n/nfs/b 10.0.0.2(rw)\n", "/nfs/a 10.0.0.1(rw)\n/nfs/c 10.0.0.3(rw)\n")
+
+	if !reflect.DeepEqual(added, []string{"/nfs/c 10.0.0.3(rw)"}) {
+		t.Errorf("added is %v", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"/nfs/b 10.0.0.2(rw)"}) {
+		t.Errorf("removed is %v", removed)
+	}
+}
+
+func TestApplyOnlyWritesChanges(t *testing.T) {
+	exporter := newTestExporter(t)
+	content := "/nfs/a 10.0.0.1(rw)\n"
+
+	changed, err := exporter.Apply(context.Background(), content)
+	if err != nil || !changed {
+		t.Fatalf("first Apply returned %v, %v", changed, err)
+	}
+
+	written, err := ioutil.ReadFile(exporter.exportsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != content {
+		t.Errorf("exports file is %q, want %q", written, content)
+	}
+
+	changed, err = exporter.Apply(context.Background(), content)
+	if err != nil || changed {
+		t.Errorf("Apply of the same exports returned %v, %v", changed, err)
+	}
+}
+
+func TestApplyRetriesAfterExportfsFails(t *testing.T) {
+	exporter := newTestExporter(t)
+	exporter.dryRun = false
+	exporter.exportfsPath = "false"
+
+	_, err := exporter.Apply(context.Background(), "/nfs/a 10.0.0.1(rw)\n")
+	if err == nil {
+		t.Fatal("Apply succeeded while exportfs failed")
+	}
+	if _, err := os.Stat(exporter.exportsFile); !os.IsNotExist(err) {
+		t.Error("the exports file was left in place after exportfs failed")
+	}
+
+	exporter.exportfsPath = "true"
+	changed, err := exporter.Apply(context.Background(), "/nfs/a 10.0.0.1(rw)\n")
+	if err != nil || !changed {
+		t.Errorf("Apply after a failed exportfs returned %v, %v", changed, err)
+	}
+}
+
+func TestCleanLegacyExports(t *testing.T) {
+	exporter := newTestExporter(t)
+	exporter.dryRun = false
+	exporter.legacyExportsFile = path.Join(t.TempDir(), "exports")
+
+	legacy := "/srv/share *(ro)\n/bakery/nfs/abc 10.0.0.1(rw)\n/bakery/nfsother *(rw)\n"
+	err := ioutil.WriteFile(exporter.legacyExportsFile, []byte(legacy), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = exporter.CleanLegacyExports("/bakery/nfs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept, err := ioutil.ReadFile(exporter.legacyExportsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(kept) != "/srv/share *(ro)\n/bakery/nfsother *(rw)\n" {
+		t.Errorf("/etc/exports is %q", kept)
+	}
+}
+
+func TestCloseRemovesDryRunFolder(t *testing.T) {
+	exporter, err := newNfsExporter("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = exporter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Dir(exporter.exportsFile)); !os.IsNotExist(err) {
+		t.Error("the dry run folder is still there")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	eventRegistered   = "registered"
+	eventStatus       = "status"
+	eventPower        = "power"
+	eventBootFile     = "bootFile"
+	eventDiskAttached = "diskAttached"
+	eventDiskDetached = "diskDetached"
+	eventBake         = "bake"
+)
+
+//piEvent is something that happened to a pi, kept to reconstruct what a pi went through when it fails to boot
+type piEvent struct {
+	Id     int64     `json:"id"`
+	PiId   string    `json:"piId"`
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Detail string    `json:"detail"`
+}
+
+//eventLog stores the events of every pi in the inventory and publishes them on the bus. Only the last keep events of a pi are kept.
+type eventLog struct {
+	store inventoryStore
+	bus   *eventBus
+	keep  int
+}
+
+func newEventLog(store inventoryStore, bus *eventBus, keep int) *eventLog {
+	return &eventLog{
+		store: store,
+		bus:   bus,
+		keep:  keep,
+	}
+}
+
+//Record stores an event. Failing to do so is logged, it never fails the operation the event is about.
+func (l *eventLog) Record(piId, eventType, detail string) {
+	if l == nil {
+		return
+	}
+
+	e := piEvent{
+		PiId:   piId,
+		Time:   time.Now().UTC(),
+		Type:   eventType,
+		Detail: detail,
+	}
+
+	err := l.store.AppendEvent(e, l.keep)
+	if err != nil {
+		log.Printf("Unable to record %v event of pi %v: %v\n", eventType, piId, err)
+	}
+
+	l.bus.Publish(busEvent{
+		Type:   e.Type,
+		Time:   e.Time,
+		PiId:   e.PiId,
+		Detail: e.Detail,
+	})
+}
+
+func (p *PiInfo) event(eventType, format string, args ...interface{}) {
+	p.events.Record(p.Id, eventType, fmt.Sprintf(format, args...))
+}
+
+//EventsHandler returns the most recent events of a pi, oldest first. Used for pis in the oven as well as in the fridge.
+func (pm *PiManager) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	piId := mux.Vars(r)["piId"]
+
+	_, err := pm.GetPi(piId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Pi not found"))
+		return
+	}
+
+	limit := 100
+	if param := r.URL.Query().Get("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > pm.events.keep {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("limit should be between 1 and %v", pm.events.keep)))
+			return
+		}
+	}
+
+	events, err := pm.store.ListEvents(piId, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	jsonBytes, err := json.Marshal(events)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
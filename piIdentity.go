@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var hostnameRegexp = regexp.MustCompile("^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$")
+
+var sshHostKeyTypes = []string{"rsa", "ecdsa", "ed25519"}
+
+type hostnameVars struct {
+	PiId     string
+	Bakeform string
+}
+
+//hostnameFor renders the configured hostname pattern for a pi
+func (pm *PiManager) hostnameFor(pi PiInfo, bf *Bakeform) (string, error) {
+	var buf bytes.Buffer
+	err := pm.hostnamePattern.Execute(&buf, hostnameVars{
+		PiId:     pi.Id,
+		Bakeform: bf.Name,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	hostname := strings.ToLower(strings.TrimSpace(buf.String()))
+	if !hostnameRegexp.MatchString(hostname) {
+		return "", fmt.Errorf("Hostname pattern produced an invalid hostname: %v", hostname)
+	}
+
+	return hostname, nil
+}
+
+//personaliseDisk sets the hostname and regenerates the machine-id and ssh host keys on a cloned root disk.
+//Every disk cloned from a bakeform starts out with the identity of the image.
+//The disk belongs to the pi, so every file is written through an os.Root and a symlink can't point a write at the server.
+func personaliseDisk(rootPath, hostname string) error {
+	root, err := os.OpenRoot(rootPath)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	err = writeHostname(root, hostname)
+	if err != nil {
+		return fmt.Errorf("Unable to set hostname. %v", err)
+	}
+
+	err = regenMachineId(root)
+	if err != nil {
+		return fmt.Errorf("Unable to regenerate machine-id. %v", err)
+	}
+
+	err = regenSshHostKeys(root, hostname)
+	if err != nil {
+		return fmt.Errorf("Unable to regenerate ssh host keys. %v", err)
+	}
+
+	return nil
+}
+
+func writeHostname(root *os.Root, hostname string) error {
+	err := root.MkdirAll("etc", 0755)
+	if err != nil {
+		return err
+	}
+
+	err = root.WriteFile("etc/hostname", []byte(hostname+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	content, err := root.ReadFile("etc/hosts")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.IsNotExist(err) {
+		content = []byte("127.0.0.1\tlocalhost\n")
+	}
+
+	//debian style images map the hostname to 127.0.1.1. Replace that entry or add one.
+	hostsEntry := "127.0.1.1\t" + hostname
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	found := false
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "127.0.1.1" {
+			lines[i] = hostsEntry
+			found = true
+		}
+	}
+	if !found {
+		lines = append(lines, hostsEntry)
+	}
+
+	return root.WriteFile("etc/hosts", []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func regenMachineId(root *os.Root) error {
+	idBytes := make([]byte, 16)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return err
+	}
+	machineId := []byte(hex.EncodeToString(idBytes) + "\n")
+
+	err = root.WriteFile("etc/machine-id", machineId, 0444)
+	if err != nil {
+		return err
+	}
+
+	//dbus keeps its own copy on older images. Usually it's a symlink to /etc/machine-id, leave those alone.
+	fi, err := root.Lstat("var/lib/dbus/machine-id")
+	if err == nil && fi.Mode().IsRegular() {
+		return root.WriteFile("var/lib/dbus/machine-id", machineId, 0444)
+	}
+
+	return nil
+}
+
+//regenSshHostKeys generates new host keys in a scratch folder, ssh-keygen would follow symlinks on the disk
+func regenSshHostKeys(root *os.Root, hostname string) error {
+	if _, err := root.Stat("etc/ssh"); os.IsNotExist(err) {
+		log.Printf("No ssh config found on disk. Skipping host key generation")
+		return nil
+	}
+
+	oldKeys, err := fs.Glob(root.FS(), "etc/ssh/ssh_host_*")
+	if err != nil {
+		return err
+	}
+	for _, key := range oldKeys {
+		err = root.Remove(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	scratch, err := ioutil.TempDir("", "bakery-hostkeys")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	for _, keyType := range sshHostKeyTypes {
+		keyFile := fmt.Sprintf("ssh_host_%v_key", keyType)
+		out, err := exec.Command("ssh-keygen", "-q", "-t", keyType, "-N", "", "-C", "root@"+hostname, "-f", path.Join(scratch, keyFile)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v %v", err, string(out))
+		}
+
+		for file, mode := range map[string]os.FileMode{keyFile: 0600, keyFile + ".pub": 0644} {
+			key, err := ioutil.ReadFile(path.Join(scratch, file))
+			if err != nil {
+				return err
+			}
+			err = root.WriteFile(path.Join("etc/ssh", file), key, mode)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
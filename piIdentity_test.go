@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPersonaliseDisk(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(path.Join(root, "etc/ssh"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(root, "etc/hosts"), []byte("127.0.0.1\tlocalhost\n127.0.1.1\traspberrypi\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = personaliseDisk(root, "pi-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostname, _ := ioutil.ReadFile(path.Join(root, "etc/hostname"))
+	if string(hostname) != "pi-1\n" {
+		t.Errorf("hostname is %q", hostname)
+	}
+	hosts, _ := ioutil.ReadFile(path.Join(root, "etc/hosts"))
+	if string(hosts) != "127.0.0.1\tlocalhost\n127.0.1.1\tpi-1\n" {
+		t.Errorf("hosts is %q", hosts)
+	}
+	machineId, _ := ioutil.ReadFile(path.Join(root, "etc/machine-id"))
+	if len(machineId) != 33 {
+		t.Errorf("machine-id is %q", machineId)
+	}
+	for _, keyType := range sshHostKeyTypes {
+		fi, err := os.Stat(path.Join(root, "etc/ssh", "ssh_host_"+keyType+"_key"))
+		if err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("%v host key: %v %v", keyType, fi, err)
+		}
+	}
+}
+
+func TestPersonaliseDiskRefusesSymlinksOutOfTheDisk(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(path.Join(root, "etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outside := path.Join(t.TempDir(), "hostname")
+	err = ioutil.WriteFile(outside, []byte("server\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a pi can leave any symlink on its root disk before it is cloned
+	err = os.Symlink(outside, path.Join(root, "etc/hostname"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = personaliseDisk(root, "pi-1")
+	if err == nil {
+		t.Error("personalising wrote through a symlink out of the disk")
+	}
+
+	content, _ := ioutil.ReadFile(outside)
+	if string(content) != "server\n" {
+		t.Errorf("the file outside the disk was overwritten with %q", content)
+	}
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os/exec"
-	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type piStatus int
@@ -20,58 +20,116 @@ const (
 	PREPARING piStatus = 3
 )
 
+func (s piStatus) String() string {
+	switch s {
+	case NOTINUSE:
+		return "NOTINUSE"
+	case INUSE:
+		return "INUSE"
+	case PREPARING:
+		return "PREPARING"
+	}
+	return fmt.Sprintf("unknown (%d)", int(s))
+}
+
 type piList map[string]PiInfo
 
 type PiInfo struct {
-	db             *sql.DB
-	Id             string    `json:"id"`
-	Status         piStatus  `json:"status"`
-	Disks          []*disk   `json:"disks,omitempty"`
-	SourceBakeform *Bakeform `json:"sourceBakeform,omitempty"`
+	store          inventoryStore
+	events         *eventLog
+	Id             string            `json:"id"`
+	Status         piStatus          `json:"status"`
+	Hostname       string            `json:"hostname,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	KernelArgs     string            `json:"kernelArgs,omitempty"`
+	BootConfig     *bootConfig       `json:"bootConfig,omitempty"`
+	Address        string            `json:"address,omitempty"`
+	AddressPinned  bool              `json:"addressPinned,omitempty"`
+	Disks          []*disk           `json:"disks,omitempty"`
+	SourceBakeform *Bakeform         `json:"sourceBakeform,omitempty"`
 	ppiPath        string
 	ppiConfigPath  string
 }
 
-func (p *PiInfo) SetStatus(status piStatus) error {
+func (p *PiInfo) SetStatus(ctx context.Context, status piStatus) error {
+	previous := p.Status
 	p.Status = status
-	return p.Save()
+	err := p.Save(ctx)
+	if err == nil && previous != status {
+		p.event(eventStatus, "%v -> %v", previous, status)
+	}
+	return err
 }
 
-func (p *PiInfo) Save() error {
-	bakeformString := ""
+//claim takes a pi out of the fridge for a bake. Requests, also those of other bakeries sharing the inventory, may pick the same pi at once, only one of them claims it.
+func (p *PiInfo) claim(ctx context.Context) (bool, error) {
+	_, span := startSpan(ctx, "store.claimPi", attribute.String("bakery.pi_id", p.Id))
+	claimed, err := p.store.ClaimPi(p.Id, NOTINUSE, PREPARING)
+	endSpan(span, err)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	p.event(eventStatus, "%v -> %v", p.Status, PREPARING)
+	p.Status = PREPARING
+	return true, nil
+}
+
+func (p *PiInfo) Save(ctx context.Context) (err error) {
+	_, span := startSpan(ctx, "store.savePi", attribute.String("bakery.pi_id", p.Id))
+	defer func() { endSpan(span, err) }()
+
+	record := piRecord{
+		Id:            p.Id,
+		Status:        p.Status,
+		Hostname:      p.Hostname,
+		KernelArgs:    p.KernelArgs,
+		Address:       p.Address,
+		AddressPinned: p.AddressPinned,
+	}
+
 	if p.SourceBakeform != nil {
-		bakeformString = p.SourceBakeform.Name
+		record.Bakeform = p.SourceBakeform.Name
 	}
 
-	_, err := p.db.Exec(fmt.Sprintf("insert into inventory(id, status, bakeform, diskIds) values('%v', %v, '%v', '%v')", p.Id, p.Status, bakeformString, ""))
-	if err != nil {
-		if err.Error() == "UNIQUE constraint failed: inventory.id" {
-			var diskIds []string
-			for _, diskStruct := range p.Disks {
-				if diskStruct != nil {
-					diskIds = append(diskIds, diskStruct.ID)
-				}
-			}
+	if len(p.Labels) > 0 {
+		labelsBytes, err := json.Marshal(p.Labels)
+		if err != nil {
+			return err
+		}
+		record.Labels = string(labelsBytes)
+	}
 
-			diskIdsString := strings.Join(diskIds, ",")
-			stmt := fmt.Sprintf("update inventory set status = %v, bakeform = '%v', diskIds = '%v' where id = '%v'", p.Status, bakeformString, diskIdsString, p.Id)
-			_, err := p.db.Exec(stmt)
-			if err != nil {
-				return err
-			}
-		} else {
+	if !p.BootConfig.isEmpty() {
+		bootConfigBytes, err := json.Marshal(p.BootConfig)
+		if err != nil {
 			return err
 		}
+		record.BootConfig = string(bootConfigBytes)
 	}
 
-	return nil
+	for _, dsk := range p.Disks {
+		diskId := ""
+		if dsk != nil {
+			diskId = dsk.ID
+		}
+		record.DiskIds = append(record.DiskIds, diskId)
+	}
+
+	return p.store.SavePi(record)
 }
 
-func (p *PiInfo) Unbake(dm *diskManager) error {
-	log.Printf("Unbaking pi with id: %v\n", p.Id)
-	err := p.PowerOff()
+func (p *PiInfo) Unbake(ctx context.Context, dm *diskManager) (err error) {
+	ctx, span := startSpan(ctx, "Unbake", attribute.String("bakery.pi_id", p.Id))
+	defer func() { endSpan(span, err) }()
+
+	logger := loggerFrom(ctx).With("piId", p.Id)
+	logger.Info("Unbaking pi")
+	_, step := startSpan(ctx, "Unbake.powerOff")
+	err = p.PowerOff(ctx)
+	endSpan(step, err)
 	if err != nil {
-		log.Println(err.Error())
+		logger.Error("Unable to power off pi", "error", err)
 		return err
 	}
 
@@ -79,33 +137,57 @@ func (p *PiInfo) Unbake(dm *diskManager) error {
 	disks := p.Disks
 
 	//Set state to NOTINUSE and Store State
+	_, step = startSpan(ctx, "Unbake.save")
+	previous := p.Status
 	p.Status = NOTINUSE
 	p.SourceBakeform = nil
-	err = p.Save()
+	p.Hostname = ""
+	p.Labels = nil
+	p.KernelArgs = ""
+	p.Disks = nil
+	if !p.AddressPinned {
+		p.Address = "" //learned again on the next bake
+	}
+	err = p.Save(ctx)
+	endSpan(step, err)
 	if err != nil {
 		return err
 	}
+	p.event(eventStatus, "%v -> %v", previous, NOTINUSE)
 
 	//delete attached disks (including root)
 	for _, d := range disks {
 		if d == nil {
 			continue
 		}
-		log.Println("Destroying disk: " + d.Location)
-		err := dm.DestroyDisk(d.ID)
+		logger.Info("Destroying disk", "diskId", d.ID, "location", d.Location)
+		stepCtx, step := startSpan(ctx, "Unbake.destroyDisk", attribute.String("bakery.disk_id", d.ID))
+		err := dm.DestroyDisk(stepCtx, d.ID)
+		endSpan(step, err)
 		if err != nil {
-			log.Println(err.Error())
+			logger.Error("Unable to destroy disk", "diskId", d.ID, "error", err)
 		}
 	}
 
 	return err
 }
 
-func (p *PiInfo) doPpiAction(action string) error {
+func (p *PiInfo) doPpiAction(ctx context.Context, action string) (err error) {
 	if action != "poweron" && action != "poweroff" {
 		return fmt.Errorf("action %v not supported", action)
 	}
 
+	_, span := startSpan(ctx, "ppi."+action, attribute.String("bakery.pi_id", p.Id))
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+	defer func() {
+		ppiDuration.WithLabelValues(action).Observe(time.Since(start).Seconds())
+		if err != nil {
+			ppiErrors.WithLabelValues(action).Inc()
+		}
+	}()
+
 	params := ppiParams{
 		PiId:   p.Id,
 		Action: action,
@@ -139,57 +221,102 @@ func (p *PiInfo) doPpiAction(action string) error {
 	err = ppicmd.Wait()
 	if err != nil || len(outerr) != 0 || string(out) != "ok" {
 		//log.Printf("ppi output: %v/%v", string(outerr), string(out))
+		p.event(eventPower, "%v failed: %v %v", action, string(outerr), string(out))
 		return fmt.Errorf("%v %v", string(outerr), string(out))
 	}
 
+	p.event(eventPower, "%v", action)
 	return nil
 }
 
-func (p *PiInfo) PowerOn() error {
-	return p.doPpiAction("poweron")
+func (p *PiInfo) PowerOn(ctx context.Context) error {
+	return p.doPpiAction(ctx, "poweron")
 }
 
-func (p *PiInfo) PowerOff() error {
-	return p.doPpiAction("poweroff")
+func (p *PiInfo) PowerOff(ctx context.Context) error {
+	return p.doPpiAction(ctx, "poweroff")
 }
 
-func (p *PiInfo) PowerCycle() error {
-	err := p.doPpiAction("poweroff")
+func (p *PiInfo) PowerCycle(ctx context.Context) error {
+	err := p.doPpiAction(ctx, "poweroff")
 	if err != nil {
 		return err
 	}
 
 	time.Sleep(1 * time.Second)
 
-	return p.doPpiAction("poweron")
+	return p.doPpiAction(ctx, "poweron")
 }
 
-func (p *PiInfo) AttachDisk(dsk *disk) error {
+//AttachDisk attaches a data disk. The first position is kept for the root disk, data disks take the first free position after it.
+func (p *PiInfo) AttachDisk(ctx context.Context, dsk *disk) error {
+	logger := loggerFrom(ctx).With("piId", p.Id, "diskId", dsk.ID)
+
 	//Check if disk is already attached. Early return if so
 	for _, disk := range p.Disks {
-		if disk == dsk {
-			log.Printf("AttachDisk: disk %v already attached", dsk.ID)
+		if disk != nil && disk.ID == dsk.ID {
+			logger.Info("Disk already attached")
 			return nil
 		}
 	}
 
 	//not attached? attach now and save.
-	p.Disks = append(p.Disks, dsk)
-	log.Printf("AttachDisk: Attached %v", dsk.ID)
-	return p.Save()
+	if len(p.Disks) == 0 {
+		p.Disks = []*disk{nil}
+	}
+	position := len(p.Disks)
+	for i := 1; i < len(p.Disks); i++ {
+		if p.Disks[i] == nil {
+			position = i
+			break
+		}
+	}
+	if position == len(p.Disks) {
+		p.Disks = append(p.Disks, nil)
+	}
+	p.Disks[position] = dsk
+
+	logger.Info("Disk attached")
+	err := p.Save(ctx)
+	if err == nil {
+		p.event(eventDiskAttached, "%v", dsk.ID)
+	}
+	return err
 }
 
-func (p *PiInfo) DetachDisk(dsk *disk) error {
+//AttachRootDisk makes dsk the disk the pi boots from
+func (p *PiInfo) AttachRootDisk(ctx context.Context, dsk *disk) error {
+	if len(p.Disks) == 0 {
+		p.Disks = []*disk{nil}
+	}
+	if p.Disks[0] != nil && p.Disks[0].ID != dsk.ID {
+		return fmt.Errorf("Pi %v already has root disk %v", p.Id, p.Disks[0].ID)
+	}
+
+	p.Disks[0] = dsk
+	loggerFrom(ctx).Info("Root disk attached", "piId", p.Id, "diskId", dsk.ID)
+	err := p.Save(ctx)
+	if err == nil {
+		p.event(eventDiskAttached, "%v", dsk.ID)
+	}
+	return err
+}
+
+func (p *PiInfo) DetachDisk(ctx context.Context, dsk *disk) error {
 	for i, d := range p.Disks {
 		//find the disk in the array
-		if d.ID == dsk.ID {
+		if d != nil && d.ID == dsk.ID {
 			if i == 0 { //do not try to detach system disk
 				return fmt.Errorf("Cannot unassociate boot volume")
 			}
 			//delete disk from array
 			p.Disks = append(p.Disks[:i], p.Disks[i+1:]...)
-			log.Printf("DetachDisk: disk %v detached", dsk.ID)
-			return p.Save()
+			loggerFrom(ctx).Info("Disk detached", "piId", p.Id, "diskId", dsk.ID)
+			err := p.Save(ctx)
+			if err == nil {
+				p.event(eventDiskDetached, "%v", dsk.ID)
+			}
+			return err
 		}
 	}
 	//if loop exits we didn't find the disk in the Pi
@@ -1,19 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"path"
-	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	"database/sql"
 
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type piManager interface {
@@ -21,7 +24,7 @@ type piManager interface {
 	GetPi(piId string) (PiInfo, error)
 	ListFridge() (piList, error)
 	ListOven() (piList, error)
-	BakePi(PiInfo, *Bakeform)
+	BakePi(context.Context, PiInfo, *Bakeform, bakeRequest)
 	BakeHandler(http.ResponseWriter, *http.Request)
 	UnbakeHandler(http.ResponseWriter, *http.Request)
 	GetPiHandler(w http.ResponseWriter, r *http.Request)
@@ -32,56 +35,77 @@ type piManager interface {
 	DetachDiskHandler(w http.ResponseWriter, r *http.Request)
 	UploadHandler(w http.ResponseWriter, r *http.Request)
 	DownloadHandler(w http.ResponseWriter, r *http.Request)
+	GetBootConfigHandler(w http.ResponseWriter, r *http.Request)
+	SetBootConfigHandler(w http.ResponseWriter, r *http.Request)
+	SetAddressHandler(w http.ResponseWriter, r *http.Request)
+	RestoreSnapshotHandler(w http.ResponseWriter, r *http.Request)
+	CaptureHandler(w http.ResponseWriter, r *http.Request)
+	GetCaptureHandler(w http.ResponseWriter, r *http.Request)
+	EventsHandler(w http.ResponseWriter, r *http.Request)
+	LearnAddress(ctx context.Context, pi PiInfo, address string)
 }
 
 type PiManager struct {
-	db                 *sql.DB
+	store              inventoryStore
 	bakeforms          bakeformInventory
 	diskManager        *diskManager
 	piProvisionMutexes map[string]*sync.Mutex
 	ppiPath            string
 	ppiConfigPath      string
+	hostnamePattern    *template.Template
+	captures           map[string]*captureJob
+	captureMutex       *sync.Mutex
+	events             *eventLog
+	webhooks           *webhookNotifier
 }
 
 type bakeRequest struct {
-	BakeformName string `json:"bakeformName"`
+	BakeformName string            `json:"bakeformName"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	KernelArgs   string            `json:"kernelArgs,omitempty"`
+	RootMode     string            `json:"rootMode,omitempty"`
+	CallbackUrl  string            `json:"callbackUrl,omitempty"` //notified when the bake completes or fails
 }
 
-func NewPiManager(bakeforms bakeformInventory, dm *diskManager, inventoryDbPath, ppiPath, ppiConfigPath string) (piManager, error) {
-	db, err := sql.Open("sqlite3", inventoryDbPath)
-	sqlStmt := "create table if not exists inventory (id text not null primary key, status integer, bakeform text, diskIds text);"
-
-	_, err = db.Exec(sqlStmt)
+func NewPiManager(bakeforms bakeformInventory, dm *diskManager, store inventoryStore, events *eventLog, webhooks *webhookNotifier, ppiPath, ppiConfigPath, hostnamePattern string) (piManager, error) {
+	hostnameTemplate, err := template.New("hostname").Parse(hostnamePattern)
 	if err != nil {
-		return &PiManager{}, err
+		return &PiManager{}, fmt.Errorf("Invalid hostname pattern. %v", err)
 	}
 
 	newInv := &PiManager{
-		db:                 db,
+		store:              store,
 		bakeforms:          bakeforms,
 		piProvisionMutexes: make(map[string]*sync.Mutex),
 		diskManager:        dm,
 		ppiPath:            ppiPath,
 		ppiConfigPath:      ppiConfigPath,
+		hostnamePattern:    hostnameTemplate,
+		captures:           make(map[string]*captureJob),
+		captureMutex:       &sync.Mutex{},
+		events:             events,
+		webhooks:           webhooks,
 	}
 
 	stuckPis, _ := newInv.listPis(PREPARING)
 	log.Println("unstucking Pis that are stuck in the PREPARING state.")
 	for _, pi := range stuckPis {
-		pi.Status = NOTINUSE
-		err := pi.Save()
+		err := pi.SetStatus(context.Background(), NOTINUSE)
 		if err != nil {
 			log.Println(err.Error())
 		}
 	}
 
+	newInv.updateExports(context.Background())
+
 	return newInv, nil
 }
 
 //NewPi just returns a new piInfo struct. It does not register the info in the DB. Use piInfo.Save() to do so.
 func (i *PiManager) NewPi(piId string) PiInfo {
 	return PiInfo{
-		db:            i.db,
+		store:         i.store,
+		events:        i.events,
 		Id:            piId,
 		Status:        NOTINUSE,
 		ppiPath:       i.ppiPath,
@@ -91,35 +115,59 @@ func (i *PiManager) NewPi(piId string) PiInfo {
 
 //GetPi finds the pi in the DB. If the pi is not found an empty piInfo struct and an error is returned
 func (i *PiManager) GetPi(piId string) (PiInfo, error) {
-	rows, err := i.db.Query(fmt.Sprintf("select id, status, bakeform, diskIds from inventory where id = '%v'", piId))
+	record, err := i.store.GetPi(piId)
+	if err == sql.ErrNoRows {
+		return PiInfo{}, fmt.Errorf("%v not found in inventory", piId)
+	}
 	if err != nil {
 		return PiInfo{}, err
 	}
-	defer rows.Close()
 
-	if rows.Next() {
-		var id, bakeform, diskIdsString string
-		var status piStatus
+	return i.piFromRecord(record), nil
+}
 
-		rows.Scan(&id, &status, &bakeform, &diskIdsString)
-		pi := PiInfo{
-			db:             i.db,
-			Id:             id,
-			Status:         status,
-			SourceBakeform: i.bakeforms.List()[bakeform],
-			ppiPath:        i.ppiPath,
-			ppiConfigPath:  i.ppiConfigPath,
+//piFromRecord builds a piInfo struct from a stored pi. The root disk is at position 0 of Disks, it is nil if the pi has none.
+func (i *PiManager) piFromRecord(record piRecord) PiInfo {
+	pi := PiInfo{
+		store:          i.store,
+		events:         i.events,
+		Id:             record.Id,
+		Status:         record.Status,
+		Hostname:       record.Hostname,
+		KernelArgs:     record.KernelArgs,
+		Address:        record.Address,
+		AddressPinned:  record.AddressPinned,
+		SourceBakeform: i.bakeforms.List()[record.Bakeform],
+		ppiPath:        i.ppiPath,
+		ppiConfigPath:  i.ppiConfigPath,
+	}
+
+	if record.Labels != "" {
+		err := json.Unmarshal([]byte(record.Labels), &pi.Labels)
+		if err != nil {
+			log.Printf("Unable to parse labels of pi %v: %v\n", record.Id, err)
 		}
+	}
 
-		diskIds := strings.Split(diskIdsString, ",")
-		for _, diskId := range diskIds {
-			pi.Disks = append(pi.Disks, i.diskManager.Disks[diskId])
+	if record.BootConfig != "" {
+		pi.BootConfig = &bootConfig{}
+		err := json.Unmarshal([]byte(record.BootConfig), pi.BootConfig)
+		if err != nil {
+			log.Printf("Unable to parse boot config of pi %v: %v\n", record.Id, err)
 		}
+	}
 
-		return pi, nil
+	pi.Disks = []*disk{nil}
+	for position, diskId := range record.DiskIds {
+		if position > 0 {
+			pi.Disks = append(pi.Disks, nil)
+		}
+		if diskId != "" {
+			pi.Disks[position], _ = i.diskManager.GetDisk(diskId)
+		}
 	}
 
-	return PiInfo{}, fmt.Errorf("%v not found in inventory", piId)
+	return pi
 }
 
 func (i *PiManager) ListFridge() (piList, error) {
@@ -140,90 +188,239 @@ func (i *PiManager) ListOven() (piList, error) {
 	return nil, err
 }
 
-func (pm *PiManager) BakePi(pi PiInfo, bf *Bakeform) {
+//BakePi turns a pi from the fridge into a pi running bf. ctx carries the request id and trace of the bake request.
+func (pm *PiManager) BakePi(ctx context.Context, pi PiInfo, bf *Bakeform, req bakeRequest) {
+	logger := loggerFrom(ctx).With("piId", pi.Id, "bakeform", bf.Name)
+
 	if _, exists := pm.piProvisionMutexes[pi.Id]; !exists {
 		pm.piProvisionMutexes[pi.Id] = &sync.Mutex{}
 	}
 	pm.piProvisionMutexes[pi.Id].Lock()
 	defer pm.piProvisionMutexes[pi.Id].Unlock()
 
-	log.Printf("Baking pi: %v\n", pi.Id)
+	ctx, span := startSpan(ctx, "BakePi", attribute.String("bakery.pi_id", pi.Id), attribute.String("bakery.bakeform", bf.Name))
+	var err error
+	defer func() { endSpan(span, err) }()
+
+	logger.Info("Baking pi")
+	bakeStart := time.Now()
+	bakeResult := "failed"
+	defer func() {
+		bakeDuration.WithLabelValues(bakeResult).Observe(time.Since(bakeStart).Seconds())
+	}()
+
+	pi.event(eventBake, "started with bakeform %v", bf.Name)
+
+	//a pi can boot from another address than it did for its previous bake, unless the address was configured it is learned again
+	if !pi.AddressPinned {
+		pi.Address = ""
+	}
 
 	//update the status to PREPARING
-	if err := pi.SetStatus(PREPARING); err != nil {
-		log.Println(err)
+	stepCtx, step := startSpan(ctx, "BakePi.prepare")
+	err = pi.SetStatus(stepCtx, PREPARING)
+	endSpan(step, err)
+	if err != nil {
+		logger.Error("Unable to mark pi as preparing", "error", err)
+		pm.webhooks.Notify(webhookBakeFailed, pi, req.CallbackUrl, err)
 		return
 	}
 
 	//Deploy the disk from image
-	log.Println("Cloning bakeform...")
-	dsk, err := pm.diskManager.DiskFromBakeform(bf)
+	logger.Info("Cloning bakeform")
+	pi.event(eventBake, "cloning bakeform")
+	phaseStart := time.Now()
+	stepCtx, step = startSpan(ctx, "BakePi.clone")
+	dsk, err := pm.diskManager.DiskFromBakeform(withLogger(stepCtx, loggerFrom(stepCtx).With("piId", pi.Id)), bf, diskMode(req.RootMode))
+	endSpan(step, err)
+	bakePhaseDuration.WithLabelValues("clone").Observe(time.Since(phaseStart).Seconds())
 	if err != nil {
-		log.Println(err.Error())
-		pi.SetStatus(NOTINUSE)
+		logger.Error("Unable to clone bakeform", "error", err)
+		pi.event(eventBake, "failed: %v", err)
+		pi.SetStatus(ctx, NOTINUSE)
+		pm.webhooks.Notify(webhookBakeFailed, pi, req.CallbackUrl, err)
 		return
 	}
+	span.SetAttributes(attribute.String("bakery.disk_id", dsk.ID))
+
+	//Give the pi its own identity so baked pis don't all look the same on the network
+	logger.Info("Personalising cloned disk", "diskId", dsk.ID)
+	pi.event(eventBake, "personalising disk %v", dsk.ID)
+	phaseStart = time.Now()
+	_, step = startSpan(ctx, "BakePi.personalise")
+	hostname, err := pm.hostnameFor(pi, bf)
+	if err == nil {
+		err = pm.diskManager.withDiskRoot(dsk, false, func(root string) error {
+			return personaliseDisk(root, hostname)
+		})
+	}
+	endSpan(step, err)
+	bakePhaseDuration.WithLabelValues("personalise").Observe(time.Since(phaseStart).Seconds())
+	if err != nil {
+		logger.Error("Unable to personalise disk", "diskId", dsk.ID, "error", err)
+		pi.event(eventBake, "failed: %v", err)
+		pm.diskManager.DestroyDisk(ctx, dsk.ID)
+		pi.SetStatus(ctx, NOTINUSE)
+		pm.webhooks.Notify(webhookBakeFailed, pi, req.CallbackUrl, err)
+		return
+	}
+	pi.Hostname = hostname
 
 	//Attach the disk to the pi
-	log.Println("Attaching cloned disk")
-	err = pi.AttachDisk(dsk)
+	logger.Info("Attaching cloned disk", "diskId", dsk.ID)
+	pi.event(eventBake, "attaching disk %v", dsk.ID)
+	phaseStart = time.Now()
+	stepCtx, step = startSpan(ctx, "BakePi.attach")
+	err = pi.AttachRootDisk(stepCtx, dsk)
+	endSpan(step, err)
+	bakePhaseDuration.WithLabelValues("attach").Observe(time.Since(phaseStart).Seconds())
 	if err != nil {
-		log.Println(err.Error())
-		pm.diskManager.DestroyDisk(dsk.ID)
-		pi.SetStatus(NOTINUSE)
+		logger.Error("Unable to attach disk", "diskId", dsk.ID, "error", err)
+		pi.event(eventBake, "failed: %v", err)
+		pm.diskManager.DestroyDisk(ctx, dsk.ID)
+		pi.SetStatus(ctx, NOTINUSE)
+		pm.webhooks.Notify(webhookBakeFailed, pi, req.CallbackUrl, err)
 		return
 	}
 
-	pi.Status = INUSE
+	stepCtx, step = startSpan(ctx, "BakePi.finish")
 	pi.SourceBakeform = bf
-	pi.Save()
-
-	log.Printf("Pi with id %v is ready!\n", pi.Id)
+	pi.SetStatus(stepCtx, INUSE)
+	pm.updateExports(stepCtx)
+	endSpan(step, nil)
+
+	logger.Info("Pi is ready!", "hostname", pi.Hostname)
+	bakeResult = "completed"
+	pi.event(eventBake, "done")
+	pm.webhooks.Notify(webhookBakeCompleted, pi, req.CallbackUrl, nil)
 }
 
-func (pm *PiManager) UnbakePi(pi *PiInfo, bf *Bakeform) {
+func (pm *PiManager) UnbakePi(ctx context.Context, pi *PiInfo) {
 	if _, exists := pm.piProvisionMutexes[pi.Id]; !exists {
 		pm.piProvisionMutexes[pi.Id] = &sync.Mutex{}
 	}
 	pm.piProvisionMutexes[pi.Id].Lock()
 	defer pm.piProvisionMutexes[pi.Id].Unlock()
 
-	err := pi.Unbake(pm.diskManager)
+	//webhooks get the pi as it was, before its disks and hostname are gone
+	baked := *pi
+	baked.Disks = append([]*disk{}, pi.Disks...)
+
+	err := pi.Unbake(ctx, pm.diskManager)
 	if err != nil {
-		log.Println(err.Error())
+		loggerFrom(ctx).Error("Unable to unbake pi", "piId", pi.Id, "error", err)
+	}
+
+	pm.updateExports(ctx)
+
+	if err == nil {
+		pm.webhooks.Notify(webhookUnbaked, baked, "", nil)
 	}
 }
 
-func (i *PiManager) listPis(qStatus piStatus) (piList, error) {
-	list := make(piList)
+//updateExports limits the NFS exports of every disk to the pis it is attached to
+func (pm *PiManager) updateExports(ctx context.Context) {
+	pis, err := pm.ListOven()
+	if err != nil {
+		loggerFrom(ctx).Error("Unable to update NFS exports", "error", err)
+		return
+	}
 
-	rows, err := i.db.Query(fmt.Sprintf("select id, status, bakeform, diskIds from inventory where status = %v", qStatus))
+	clients := make(map[string][]string)
+	for _, pi := range pis {
+		if pi.Address == "" {
+			continue
+		}
+		for _, dsk := range pi.Disks {
+			if dsk != nil {
+				clients[dsk.ID] = append(clients[dsk.ID], pi.Address)
+			}
+		}
+	}
+
+	err = pm.diskManager.ExportTo(ctx, clients)
 	if err != nil {
-		return list, err
+		loggerFrom(ctx).Error("Unable to update NFS exports", "error", err)
 	}
-	defer rows.Close()
+}
 
-	for rows.Next() {
-		var id, bakeform, diskIdsString string
-		var status piStatus
+//LearnAddress records the address a pi first boots from after it is baked, unless its address was configured through the api.
+//Boot requests are not authenticated, so a known address is never replaced. Otherwise any host could move the exports of a pi to itself.
+//A pi that really moved gets its new address through the api, or learns it again after it is unbaked.
+func (pm *PiManager) LearnAddress(ctx context.Context, pi PiInfo, address string) {
+	if pi.AddressPinned || pi.Address == address || address == "" {
+		return
+	}
 
-		rows.Scan(&id, &status, &bakeform, &diskIdsString)
+	logger := loggerFrom(ctx).With("piId", pi.Id, "address", address)
+	if pi.Address != "" {
+		logger.Warn("Ignoring boot request from an address that is not the address of the pi", "knownAddress", pi.Address)
+		return
+	}
 
-		pi := PiInfo{
-			db:             i.db,
-			Id:             id,
-			Status:         status,
-			SourceBakeform: i.bakeforms.List()[bakeform],
-			ppiPath:        i.ppiPath,
-			ppiConfigPath:  i.ppiConfigPath,
-		}
+	logger.Info("Pi boots from a new address")
+	pi.Address = address
+	err := pi.Save(ctx)
+	if err != nil {
+		logger.Error("Unable to save address of pi", "error", err)
+		return
+	}
 
-		diskIds := strings.Split(diskIdsString, ",")
-		for _, diskId := range diskIds {
-			pi.Disks = append(pi.Disks, i.diskManager.Disks[diskId])
-		}
+	pm.updateExports(ctx)
+}
+
+func (pm *PiManager) SetAddressHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var params struct {
+		Address string `json:"address"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error parsing posted data"))
+		return
+	}
+
+	if params.Address != "" && net.ParseIP(params.Address) == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid address"))
+		return
+	}
 
-		list[id] = pi
+	pi, err := pm.GetPi(mux.Vars(r)["piId"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Pi not found"))
+		return
+	}
+
+	//an empty address goes back to learning the address when the pi boots
+	pi.Address = params.Address
+	pi.AddressPinned = params.Address != ""
+	err = pi.Save(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	pm.updateExports(r.Context())
+
+	jsonBytes, _ := json.Marshal(pi)
+	w.Write(jsonBytes)
+}
+
+func (i *PiManager) listPis(qStatus piStatus) (piList, error) {
+	list := make(piList)
+
+	records, err := i.store.ListPis(qStatus)
+	if err != nil {
+		return list, err
+	}
+
+	for _, record := range records {
+		list[record.Id] = i.piFromRecord(record)
 	}
 
 	return list, nil
@@ -239,6 +436,33 @@ func (pm *PiManager) BakeHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 	}
 
+	if params.CallbackUrl != "" {
+		if !pm.webhooks.signs() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Callbacks need WEBHOOK_SECRET to be set"))
+			return
+		}
+
+		err = pm.webhooks.validateCallbackUrl(params.CallbackUrl)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	rootMode, err := parseDiskMode(params.RootMode)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if rootMode == blockDisk && !pm.diskManager.NbdEnabled() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("block root disks need the NBD server to be enabled"))
+		return
+	}
+
 	sourceBakeform := pm.bakeforms.List()
 	useBakeForm, exists := sourceBakeform[params.BakeformName]
 	if !exists {
@@ -254,11 +478,19 @@ func (pm *PiManager) BakeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//select one from the list. don't really care which one
+	//select one from the list. don't really care which one, as long as no other request claimed it first
 	targetPiId := ""
-	for key, _ := range list {
-		targetPiId = key
-		break
+	for key, pi := range list {
+		claimed, err := pi.claim(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if claimed {
+			targetPiId = key
+			list[key] = pi
+			break
+		}
 	}
 
 	if targetPiId == "" {
@@ -267,7 +499,10 @@ func (pm *PiManager) BakeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setAuditTarget(r, targetPiId)
 	targetPi := list[targetPiId]
+	targetPi.Labels = params.Labels
+	targetPi.KernelArgs = params.KernelArgs
 
 	jsonBytes, err := json.Marshal(targetPi)
 	if err != nil {
@@ -280,7 +515,8 @@ func (pm *PiManager) BakeHandler(w http.ResponseWriter, r *http.Request) {
 
 	//Start the provisioning process (baking) asynchronously and return the piInfo object for the selected pi
 	//the client should check /api/v1/oven/{piId} for the status of the pi
-	go pm.BakePi(targetPi, useBakeForm)
+	//the bake outlives the request, but keeps its request id
+	go pm.BakePi(context.WithoutCancel(r.Context()), targetPi, useBakeForm, params)
 }
 
 func (i *PiManager) UnbakeHandler(w http.ResponseWriter, r *http.Request) {
@@ -299,7 +535,7 @@ func (i *PiManager) UnbakeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go pi.Unbake(i.diskManager)
+	go i.UnbakePi(context.WithoutCancel(r.Context()), &pi)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -360,7 +596,7 @@ func (i *PiManager) RebootHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = pi.PowerCycle()
+	err = pi.PowerCycle(r.Context())
 	if err != nil {
 		log.Println(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -393,19 +629,41 @@ func (pm *PiManager) AttachDiskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dsk, exists := pm.diskManager.Disks[associateRequest.DiskId]
+	dsk, exists := pm.diskManager.GetDisk(associateRequest.DiskId)
 	if !exists {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Disk not found"))
 		return
 	}
 
-	err = pi.AttachDisk(dsk)
+	//the disk is added to the fstab on the root disk, which can't be changed while the pi is running from a block disk
+	if len(pi.Disks) > 0 && pi.Disks[0] != nil && pm.diskManager.rootInUse(pi.Disks[0]) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("The block root disk of the pi is in use. Power off the pi to attach disks"))
+		return
+	}
+
+	err = pi.AttachDisk(r.Context(), dsk)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("error associating disk"))
 		return
 	}
+
+	//make the disk show up on the pi. Pis without a root disk have nothing to surface it to.
+	root := pi.Disks[0]
+	if root != nil && root != dsk {
+		err = pm.diskManager.SurfaceDisk(root, dsk)
+		if err != nil {
+			log.Printf("Unable to surface disk %v on pi %v: %v\n", dsk.ID, pi.Id, err)
+			pi.DetachDisk(r.Context(), dsk)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	pm.updateExports(r.Context())
 }
 
 func (pm *PiManager) DetachDiskHandler(w http.ResponseWriter, r *http.Request) {
@@ -420,14 +678,37 @@ func (pm *PiManager) DetachDiskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dsk, exists := pm.diskManager.Disks[diskId]
+	dsk, exists := pm.diskManager.GetDisk(diskId)
 	if !exists {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Disk not found"))
 		return
 	}
 
-	err = pi.DetachDisk(dsk)
+	if len(pi.Disks) > 0 && pi.Disks[0] != nil && pm.diskManager.rootInUse(pi.Disks[0]) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("The block root disk of the pi is in use. Power off the pi to detach disks"))
+		return
+	}
+
+	err = pi.DetachDisk(r.Context(), dsk)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if pi.Disks[0] != nil {
+		err = pm.diskManager.UnsurfaceDisk(pi.Disks[0], dsk)
+		if err != nil {
+			log.Printf("Unable to remove disk %v from pi %v: %v\n", dsk.ID, pi.Id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	pm.updateExports(r.Context())
 }
 
 func (pm *PiManager) UploadHandler(w http.ResponseWriter, r *http.Request) {
@@ -446,9 +727,10 @@ func (pm *PiManager) UploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	content, _ := ioutil.ReadAll(r.Body)
 
-	if pi.Status != INUSE || len(pi.Disks) == 0 {
+	if pi.Status != INUSE || len(pi.Disks) == 0 || pi.Disks[0] == nil {
 		w.WriteHeader(http.StatusNotExtended)
 		w.Write([]byte("Pi not in ready state"))
+		return
 	}
 
 	//Lock the povisioning mutex to prevent the pi from disappearing while we put a file
@@ -482,6 +764,11 @@ func (pm *PiManager) DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(pi.Disks) == 0 || pi.Disks[0] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Pi has no root disk"))
+		return
+	}
 	diskId := pi.Disks[0].ID
 
 	content, err := pm.diskManager.GetFileFromDisk(diskId, filename)
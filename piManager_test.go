@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+//newTestPiManager sets up a pi manager on a sqlite inventory and an NFS root in a temp folder. Exports are checked in memory, as with the embedded NFS server.
+func newTestPiManager(t *testing.T) (*PiManager, *FileBackend) {
+	t.Helper()
+	dir := t.TempDir()
+
+	store, err := openInventory(path.Join(dir, "inventory.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nfsRoot := path.Join(dir, "nfs")
+	for _, folder := range []string{nfsRoot, path.Join(dir, "boot"), path.Join(dir, "images"), path.Join(dir, "mnt")} {
+		err = os.Mkdir(folder, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fb, err := newFileBackend("127.0.0.1", nfsRoot, path.Join(dir, "boot"), "3", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dm, err := NewDiskManager(store, fb, path.Join(dir, "snapshots"), "nfs", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bakeforms, err := newBakeformInventory(path.Join(dir, "images"), path.Join(dir, "mnt"), fb, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pm, err := NewPiManager(bakeforms, dm, store, nil, nil, "", "", "pi-{{.PiId}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pm.(*PiManager), fb.(*FileBackend)
+}
+
+func TestLearnAddressKeepsFirstAddress(t *testing.T) {
+	pm, fb := newTestPiManager(t)
+	ctx := context.Background()
+
+	location, err := fb.CreateNfsFolder(ctx, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := pm.diskManager.RegisterDisk(ctx, "root", location, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pi := pm.NewPi("00000000abcd")
+	pi.Status = INUSE
+	pi.Disks = []*disk{root}
+	err = pi.Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pm.LearnAddress(ctx, pi, "10.0.0.5")
+	if !fb.exportedTo("root", "10.0.0.5") {
+		t.Fatal("root disk is not exported to the address the pi booted from")
+	}
+
+	pi, err = pm.GetPi("00000000abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.LearnAddress(ctx, pi, "10.0.0.66")
+
+	if fb.exportedTo("root", "10.0.0.66") {
+		t.Error("a second address took over the export of the root disk")
+	}
+	if !fb.exportedTo("root", "10.0.0.5") {
+		t.Error("the pi lost the export of its root disk")
+	}
+
+	pi, err = pm.GetPi("00000000abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Address != "10.0.0.5" {
+		t.Errorf("address of the pi is %v, want 10.0.0.5", pi.Address)
+	}
+}
+
+//fakeRsync puts an rsync on the PATH that copies with cp, for machines without rsync
+func fakeRsync(t *testing.T) {
+	t.Helper()
+
+	bin := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"for arg in \"$@\"; do src=\"$dst\"; dst=\"$arg\"; done\n" +
+		"mkdir -p \"$dst\" && cp -a \"$src\". \"$dst\"\n"
+	err := ioutil.WriteFile(path.Join(bin, "rsync"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+}
+
+//addTestBakeform adds a bakeform that is already mounted, so baking from it needs no loop devices
+func addTestBakeform(t *testing.T, pm *PiManager, fb *FileBackend, name string) *Bakeform {
+	t.Helper()
+
+	inventory := pm.bakeforms.(*BakeformInventory)
+	rootfs := path.Join(t.TempDir(), "rootfs")
+	for _, folder := range []string{path.Join(fb.GetBootRoot(), name), path.Join(rootfs, "etc")} {
+		err := os.MkdirAll(folder, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(path.Join(inventory.folder, name+".img"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = inventory.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf := inventory.List()[name]
+	bf.MountedOn = []string{path.Join(fb.GetBootRoot(), name), rootfs}
+	return bf
+}
+
+func TestBakedPiBoots(t *testing.T) {
+	fakeRsync(t)
+	pm, fb := newTestPiManager(t)
+	ctx := context.Background()
+	bf := addTestBakeform(t, pm, fb, "raspbian")
+
+	fridgePi := pm.NewPi("00000000abcd")
+	err := fridgePi.Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//bakes start from the pi as it is in the fridge
+	pi, err := pm.GetPi("00000000abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.BakePi(ctx, pi, bf, bakeRequest{})
+
+	pi, err = pm.GetPi("00000000abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Status != INUSE {
+		t.Fatalf("pi is %v after baking", pi.Status)
+	}
+	if len(pi.Disks) != 1 || pi.Disks[0] == nil {
+		t.Fatalf("pi has disks %v after baking, want only a root disk", pi.Disks)
+	}
+
+	files, err := newFileServer(fb, pm, pm.diskManager, "", nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	booting, err := files.(*FileServer).bootingPi(ctx, pi.Id, "10.0.0.5", true)
+	if err != nil {
+		t.Fatalf("baked pi can't boot: %v", err)
+	}
+	if booting.Disks[0].ID != pi.Disks[0].ID {
+		t.Errorf("pi boots from disk %v, want %v", booting.Disks[0].ID, pi.Disks[0].ID)
+	}
+
+	//data disks never take the place of the root disk
+	location, err := fb.CreateNfsFolder(ctx, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := pm.diskManager.RegisterDisk(ctx, "data", location, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = booting.AttachDisk(ctx, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err = pm.GetPi(pi.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pi.Disks) != 2 || pi.Disks[0].ID != booting.Disks[0].ID || pi.Disks[1].ID != "data" {
+		t.Errorf("disks after attaching a data disk are %v", pi.Disks)
+	}
+}
+
+func TestLearnAddressOnlyFromThePi(t *testing.T) {
+	fakeRsync(t)
+	pm, fb := newTestPiManager(t)
+	ctx := context.Background()
+	bf := addTestBakeform(t, pm, fb, "raspbian")
+	err := ioutil.WriteFile(path.Join(fb.GetBootRoot(), "raspbian", "config.txt"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the pi kept the address of its previous bake in the fridge
+	fridgePi := pm.NewPi("00000000abcd")
+	fridgePi.Address = "10.0.0.5"
+	err = fridgePi.Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := pm.GetPi("00000000abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.BakePi(ctx, pi, bf, bakeRequest{})
+
+	pi, err = pm.GetPi("00000000abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Address != "" {
+		t.Errorf("a new bake kept address %v", pi.Address)
+	}
+
+	//a TFTP proxy fetching files for the pi through the files api
+	files, err := newFileServer(fb, pm, pm.diskManager, t.TempDir(), nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/files/00000000abcd/config.txt", nil)
+	request.RemoteAddr = "10.0.0.1:4711"
+	request = mux.SetURLVars(request, map[string]string{"piId": "00000000abcd", "filename": "config.txt"})
+	response := httptest.NewRecorder()
+	files.fileHandler(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("files api returned %v", response.Code)
+	}
+
+	pi, err = pm.GetPi("00000000abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Address != "" {
+		t.Errorf("the address of the proxy, %v, was learned", pi.Address)
+	}
+}
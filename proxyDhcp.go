@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+)
+
+//DHCP message types and options used by the proxyDHCP responder (RFC 2131, RFC 2132, PXE spec)
+const (
+	dhcpBootRequest byte = 1
+	dhcpBootReply   byte = 2
+
+	dhcpDiscover byte = 1
+	dhcpOffer    byte = 2
+	dhcpRequest  byte = 3
+	dhcpAck      byte = 5
+
+	dhcpOptPad            byte = 0
+	dhcpOptVendorSpecific byte = 43
+	dhcpOptMessageType    byte = 53
+	dhcpOptServerId       byte = 54
+	dhcpOptVendorClass    byte = 60
+	dhcpOptTftpServer     byte = 66
+	dhcpOptClientGuid     byte = 97
+	dhcpOptEnd            byte = 255
+
+	pxeOptDiscoveryControl byte = 6
+	pxeOptBootMenu         byte = 9
+	pxeOptMenuPrompt       byte = 10
+
+	dhcpHeaderLength = 236
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+//The boot ROM only netboots when the boot menu contains this exact string, trailing spaces included
+const raspberryPiBootMenu = "Raspberry Pi Boot   "
+
+//raspberryPiOUIs are the MAC address prefixes of Raspberry Pi network interfaces
+var raspberryPiOUIs = [][]byte{
+	{0x28, 0xcd, 0xc1},
+	{0x2c, 0xcf, 0x67},
+	{0xb8, 0x27, 0xeb},
+	{0xd8, 0x3a, 0xdd},
+	{0xdc, 0xa6, 0x32},
+	{0xe4, 0x5f, 0x01},
+}
+
+//proxyDhcpServer answers the PXE DHCP requests of Raspberry Pi boot ROMs with the address of the bakery TFTP server.
+//It never hands out addresses, that is left to the regular DHCP server on the network.
+type proxyDhcpServer struct {
+	iface    *net.Interface
+	serverIP net.IP
+}
+
+type dhcpPacket struct {
+	header  []byte
+	options map[byte][]byte
+}
+
+//newProxyDhcpServer creates a proxyDHCP responder on the given interface. If tftpAddress is empty the first IPv4 address of the interface is advertised.
+func newProxyDhcpServer(ifaceName, tftpAddress string) (*proxyDhcpServer, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var serverIP net.IP
+	if tftpAddress != "" {
+		serverIP = net.ParseIP(tftpAddress).To4()
+		if serverIP == nil {
+			return nil, fmt.Errorf("Invalid TFTP server address: %v", tftpAddress)
+		}
+	} else {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				serverIP = ipNet.IP.To4()
+				break
+			}
+		}
+		if serverIP == nil {
+			return nil, fmt.Errorf("Interface %v has no IPv4 address", ifaceName)
+		}
+	}
+
+	return &proxyDhcpServer{
+		iface:    iface,
+		serverIP: serverIP,
+	}, nil
+}
+
+//ListenAndServe listens on the DHCP port for DISCOVERs and on the PXE port for the follow up REQUEST
+func (p *proxyDhcpServer) ListenAndServe() error {
+	var conns []net.PacketConn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	//open both sockets before serving, so nothing is left running when the second one fails
+	for _, port := range []int{67, 4011} {
+		conn, err := p.listen(port)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn net.PacketConn) {
+			errs <- p.serve(conn)
+		}(conn)
+	}
+
+	log.Printf("ProxyDHCP listening on %v, pointing pis at %v\n", p.iface.Name, p.serverIP)
+	return <-errs
+}
+
+//listen opens a UDP socket bound to the interface. The regular DHCP server may be running on the same host, so the port is shared.
+func (p *proxyDhcpServer) listen(port int) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+					return
+				}
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); sockErr != nil {
+					return
+				}
+				sockErr = syscall.BindToDevice(int(fd), p.iface.Name)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	return lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%v", port))
+}
+
+func (p *proxyDhcpServer) serve(conn net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		req, err := parseDhcpPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		reply := p.reply(req)
+		if reply == nil {
+			continue
+		}
+
+		_, err = conn.WriteTo(reply, p.replyAddress(req, from.(*net.UDPAddr)))
+		if err != nil {
+			log.Printf("ProxyDHCP: unable to send reply: %v\n", err)
+		}
+	}
+}
+
+func parseDhcpPacket(b []byte) (*dhcpPacket, error) {
+	if len(b) < dhcpHeaderLength+len(dhcpMagicCookie) || !bytes.Equal(b[dhcpHeaderLength:dhcpHeaderLength+4], dhcpMagicCookie) {
+		return nil, fmt.Errorf("not a DHCP packet")
+	}
+
+	packet := &dhcpPacket{
+		header:  b[:dhcpHeaderLength],
+		options: make(map[byte][]byte),
+	}
+
+	opts := b[dhcpHeaderLength+4:]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || i+2+int(opts[i+1]) > len(opts) {
+			return nil, fmt.Errorf("truncated option %v", code)
+		}
+		length := int(opts[i+1])
+		packet.options[code] = opts[i+2 : i+2+length]
+		i += 2 + length
+	}
+
+	return packet, nil
+}
+
+func (d *dhcpPacket) mac() net.HardwareAddr {
+	hlen := int(d.header[2])
+	if hlen > 16 {
+		hlen = 16
+	}
+	return net.HardwareAddr(d.header[28 : 28+hlen])
+}
+
+func (d *dhcpPacket) isRaspberryPiBootRom() bool {
+	if d.header[0] != dhcpBootRequest || !strings.HasPrefix(string(d.options[dhcpOptVendorClass]), "PXEClient") {
+		return false
+	}
+
+	mac := d.mac()
+	if len(mac) != 6 {
+		return false
+	}
+
+	for _, oui := range raspberryPiOUIs {
+		if bytes.Equal(mac[:3], oui) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//reply builds the proxyDHCP answer for a boot ROM request, or returns nil if the request is none of our business
+func (p *proxyDhcpServer) reply(req *dhcpPacket) []byte {
+	if !req.isRaspberryPiBootRom() {
+		return nil
+	}
+
+	var messageType byte
+	switch msgType := req.options[dhcpOptMessageType]; {
+	case len(msgType) == 1 && msgType[0] == dhcpDiscover:
+		messageType = dhcpOffer
+	case len(msgType) == 1 && msgType[0] == dhcpRequest:
+		messageType = dhcpAck
+	default:
+		return nil
+	}
+
+	log.Printf("ProxyDHCP: directing %v to TFTP server %v\n", req.mac(), p.serverIP)
+
+	header := make([]byte, dhcpHeaderLength)
+	copy(header, req.header[:44]) //op through chaddr. The boot file name stays empty.
+	header[0] = dhcpBootReply
+	header[3] = 0                                     //hops
+	binary.BigEndian.PutUint16(header[8:], 0)         //secs
+	copy(header[16:20], net.IPv4zero.To4())           //yiaddr: address assignment is left to the real DHCP server
+	copy(header[20:24], p.serverIP)                   //siaddr: the TFTP server
+	copy(header[44:108], []byte(p.serverIP.String())) //sname
+
+	//PXE vendor options (PXE spec 2.1 table 2-1) with the boot menu entry the Raspberry Pi boot ROM looks for
+	var vendor []byte
+	vendor = appendDhcpOption(vendor, pxeOptDiscoveryControl, []byte{3})
+	vendor = appendDhcpOption(vendor, pxeOptMenuPrompt, append([]byte{0}, []byte("PXE")...))
+	vendor = appendDhcpOption(vendor, pxeOptBootMenu, append([]byte{0, 0, byte(len(raspberryPiBootMenu))}, []byte(raspberryPiBootMenu)...))
+	vendor = append(vendor, dhcpOptEnd)
+
+	reply := append(header, dhcpMagicCookie...)
+	reply = appendDhcpOption(reply, dhcpOptMessageType, []byte{messageType})
+	reply = appendDhcpOption(reply, dhcpOptServerId, p.serverIP)
+	reply = appendDhcpOption(reply, dhcpOptVendorClass, []byte("PXEClient"))
+	reply = appendDhcpOption(reply, dhcpOptTftpServer, []byte(p.serverIP.String()))
+	reply = appendDhcpOption(reply, dhcpOptVendorSpecific, vendor)
+	if guid, ok := req.options[dhcpOptClientGuid]; ok {
+		reply = appendDhcpOption(reply, dhcpOptClientGuid, guid)
+	}
+	reply = append(reply, dhcpOptEnd)
+
+	return reply
+}
+
+//replyAddress follows RFC 2131 section 4.1: relayed requests go back to the relay, clients without an address get a broadcast
+func (p *proxyDhcpServer) replyAddress(req *dhcpPacket, from *net.UDPAddr) *net.UDPAddr {
+	giaddr := net.IP(req.header[24:28])
+	if !giaddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: giaddr, Port: 67}
+	}
+
+	ciaddr := net.IP(req.header[12:16])
+	if !ciaddr.Equal(net.IPv4zero) {
+		return from
+	}
+
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+}
+
+func appendDhcpOption(b []byte, code byte, value []byte) []byte {
+	b = append(b, code, byte(len(value)))
+	return append(b, value...)
+}
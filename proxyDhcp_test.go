@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+//setupVethNetns creates a network namespace with one end of a veth pair in it. The other end stays in the namespace of the test.
+func setupVethNetns(t *testing.T) (string, string, string) {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+
+	ns := fmt.Sprintf("bakery-test-%v", os.Getpid())
+	hostIf := fmt.Sprintf("bkh%v", os.Getpid()%100000)
+	peerIf := fmt.Sprintf("bkp%v", os.Getpid()%100000)
+
+	ip := func(args ...string) error {
+		out, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ip %v: %v %s", args, err, out)
+		}
+		return nil
+	}
+
+	err := ip("netns", "add", ns)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { ip("netns", "del", ns) })
+
+	err = ip("link", "add", hostIf, "type", "veth", "peer", "name", peerIf, "netns", ns)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { ip("link", "del", hostIf) })
+
+	for _, args := range [][]string{
+		{"addr", "add", "10.213.0.1/24", "dev", hostIf},
+		{"link", "set", hostIf, "up"},
+		{"-n", ns, "link", "set", peerIf, "up"},
+	} {
+		err = ip(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return ns, hostIf, peerIf
+}
+
+//listenInNetns opens a UDP socket in a network namespace, bound to an interface. Sockets stay in the namespace they were created in.
+func listenInNetns(ns, iface string, port int) (net.PacketConn, error) {
+	type result struct {
+		conn net.PacketConn
+		err  error
+	}
+	results := make(chan result)
+
+	go func() {
+		//the thread is left in the namespace. It is thrown away when the goroutine ends without unlocking it.
+		runtime.LockOSThread()
+
+		nsFile, err := os.Open("/var/run/netns/" + ns)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer nsFile.Close()
+
+		err = unix.Setns(int(nsFile.Fd()), unix.CLONE_NEWNET)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+
+		lc := net.ListenConfig{
+			Control: func(network, address string, c syscall.RawConn) error {
+				var sockErr error
+				err := c.Control(func(fd uintptr) {
+					if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); sockErr != nil {
+						return
+					}
+					sockErr = syscall.BindToDevice(int(fd), iface)
+				})
+				if err != nil {
+					return err
+				}
+				return sockErr
+			},
+		}
+
+		conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%v", port))
+		results <- result{conn: conn, err: err}
+	}()
+
+	r := <-results
+	return r.conn, r.err
+}
+
+func testDhcpDiscover(mac net.HardwareAddr) []byte {
+	packet := make([]byte, dhcpHeaderLength)
+	packet[0] = dhcpBootRequest
+	packet[1] = 1 //ethernet
+	packet[2] = byte(len(mac))
+	binary.BigEndian.PutUint32(packet[4:], 0x12345678)
+	binary.BigEndian.PutUint16(packet[10:], 0x8000) //broadcast flag
+	copy(packet[28:], mac)
+
+	packet = append(packet, dhcpMagicCookie...)
+	packet = appendDhcpOption(packet, dhcpOptMessageType, []byte{dhcpDiscover})
+	packet = appendDhcpOption(packet, dhcpOptVendorClass, []byte("PXEClient:Arch:00000:UNDI:002001"))
+	return append(packet, dhcpOptEnd)
+}
+
+func TestProxyDhcpOverVeth(t *testing.T) {
+	ns, hostIf, peerIf := setupVethNetns(t)
+
+	server, err := newProxyDhcpServer(hostIf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, err := server.listen(67)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { serverConn.Close() })
+	go server.serve(serverConn)
+
+	client, err := listenInNetns(ns, peerIf, 68)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	broadcast := &net.UDPAddr{IP: net.IPv4bcast, Port: 67}
+	buf := make([]byte, 1500)
+
+	//other PXE clients are left to whoever else answers them
+	_, err = client.WriteTo(testDhcpDiscover(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}), broadcast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, _, err := client.ReadFrom(buf); err == nil {
+		t.Fatal("the responder answered a client that is not a Raspberry Pi")
+	}
+
+	_, err = client.WriteTo(testDhcpDiscover(net.HardwareAddr{0xdc, 0xa6, 0x32, 0x01, 0x02, 0x03}), broadcast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no offer for the pi: %v", err)
+	}
+
+	offer, err := parseDhcpPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offer.header[0] != dhcpBootReply || !bytes.Equal(offer.options[dhcpOptMessageType], []byte{dhcpOffer}) {
+		t.Errorf("expected an offer, got op %v type %v", offer.header[0], offer.options[dhcpOptMessageType])
+	}
+	if siaddr := net.IP(offer.header[20:24]); !siaddr.Equal(net.IPv4(10, 213, 0, 1)) {
+		t.Errorf("offer points at %v, want the address of %v", siaddr, hostIf)
+	}
+	if string(offer.options[dhcpOptTftpServer]) != "10.213.0.1" {
+		t.Errorf("TFTP server option is %q", offer.options[dhcpOptTftpServer])
+	}
+	if !bytes.Contains(offer.options[dhcpOptVendorSpecific], []byte(raspberryPiBootMenu)) {
+		t.Error("the offer has no Raspberry Pi boot menu")
+	}
+	if yiaddr := net.IP(offer.header[16:20]); !yiaddr.Equal(net.IPv4zero) {
+		t.Errorf("the offer hands out address %v", yiaddr)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//sqlDialect holds what differs between the databases the inventory can live in.
+//Queries are written with ? placeholders and rebound for databases that number them.
+type sqlDialect struct {
+	name           string
+	driver         string
+	numberedParams bool   //$1, $2, ... instead of ?
+	tableExists    string //counts the tables with the given name
+	migrationLock  string //serialises migrations of bakery instances sharing an inventory
+	boolType       string
+	autoIncrement  string //an integer primary key numbered by the database
+}
+
+var sqliteDialect = sqlDialect{
+	name:          "sqlite",
+	driver:        "sqlite3",
+	tableExists:   "select count(*) from sqlite_master where type = 'table' and name = ?",
+	boolType:      "integer not null default 0",
+	autoIncrement: "integer primary key autoincrement",
+}
+
+var postgresDialect = sqlDialect{
+	name:           "postgres",
+	driver:         "postgres",
+	numberedParams: true,
+	tableExists:    "select count(*) from information_schema.tables where table_schema = current_schema() and table_name = ?",
+	migrationLock:  "select pg_advisory_xact_lock(7361)",
+	boolType:       "boolean not null default false",
+	autoIncrement:  "bigserial primary key",
+}
+
+//dialectFor picks the database from the DSN. postgres:// and postgresql:// URLs are PostgreSQL, anything else is a sqlite file.
+func dialectFor(dsn string) sqlDialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect
+	}
+
+	return sqliteDialect
+}
+
+func (d sqlDialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+
+	var rebound strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(c)
+	}
+
+	return rebound.String()
+}
+
+//addColumn adds a column to an existing table, unless it is already there
+func (d sqlDialect) addColumn(tx *sql.Tx, table, column, definition string) error {
+	if d.name == "postgres" {
+		_, err := tx.Exec(fmt.Sprintf("alter table %v add column if not exists %v %v", table, column, definition))
+		return err
+	}
+
+	_, err := tx.Exec(fmt.Sprintf("alter table %v add column %v %v", table, column, definition))
+	if err != nil && strings.HasPrefix(err.Error(), "duplicate column name") {
+		return nil
+	}
+
+	return err
+}
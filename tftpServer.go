@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//TFTP opcodes (RFC 1350, RFC 2347)
+const (
+	tftpOpRRQ   uint16 = 1
+	tftpOpWRQ   uint16 = 2
+	tftpOpDATA  uint16 = 3
+	tftpOpACK   uint16 = 4
+	tftpOpERROR uint16 = 5
+	tftpOpOACK  uint16 = 6
+)
+
+//TFTP error codes
+const (
+	tftpErrNotDefined uint16 = 0
+	tftpErrNotFound   uint16 = 1
+	tftpErrAccess     uint16 = 2
+	tftpErrIllegalOp  uint16 = 4
+	tftpErrUnknownTID uint16 = 5
+	tftpErrBadOptions uint16 = 8
+)
+
+const (
+	tftpDefaultBlksize = 512
+	tftpMinBlksize     = 8
+	tftpMaxBlksize     = 65464
+	tftpDefaultTimeout = 2 * time.Second
+	tftpRetries        = 5
+	tftpBootIdle       = time.Minute //a client that requests nothing for this long starts a new boot with a new request id
+)
+
+//tftpServer serves boot files to pis that netboot from their firmware. Files are requested as {serial}/{filename},
+//the serial is used as pi id so TFTP and the files api serve exactly the same content.
+type tftpServer struct {
+	address   string
+	files     fileServer
+	bootRoot  string
+	mutex     *sync.Mutex
+	transfers map[string]bool //running transfers by client address and filename
+	boots     map[string]*tftpBoot
+}
+
+//tftpBoot is a pi fetching its boot files. Every file of a boot is logged with the same request id.
+type tftpBoot struct {
+	requestId string
+	lastSeen  time.Time
+}
+
+type tftpRequest struct {
+	filename string
+	mode     string
+	options  map[string]string
+}
+
+func newTftpServer(address string, files fileServer, nfs fileBackend) *tftpServer {
+	return &tftpServer{
+		address:   address,
+		files:     files,
+		bootRoot:  nfs.GetBootRoot(),
+		mutex:     &sync.Mutex{},
+		transfers: make(map[string]bool),
+		boots:     make(map[string]*tftpBoot),
+	}
+}
+
+func (t *tftpServer) ListenAndServe() error {
+	addr, err := net.ResolveUDPAddr("udp4", t.address)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Printf("TFTP server listening on %v\n", conn.LocalAddr())
+	return t.serve(conn)
+}
+
+//serve reads requests from conn until it is closed
+func (t *tftpServer) serve(conn *net.UDPConn) error {
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+
+	buf := make([]byte, 65536)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		//a client that doesn't hear back in time sends its request again. The transfer that is running answers it.
+		key := ""
+		if len(packet) > 2 && binary.BigEndian.Uint16(packet) == tftpOpRRQ {
+			if req, err := parseTftpRequest(packet[2:]); err == nil {
+				key = remote.String() + "\x00" + req.filename
+				if !t.startTransfer(key) {
+					continue
+				}
+			}
+		}
+
+		go func() {
+			t.handleRequest(localIP, remote, packet)
+			if key != "" {
+				t.endTransfer(key)
+			}
+		}()
+	}
+}
+
+func (t *tftpServer) startTransfer(key string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.transfers[key] {
+		return false
+	}
+	t.transfers[key] = true
+	return true
+}
+
+func (t *tftpServer) endTransfer(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.transfers, key)
+}
+
+//bootRequestId returns the request id of the boot of a pi by a client. Pis don't send anything to tie their requests together,
+//requests from the same address for the same pi belong to one boot until the client goes quiet.
+func (t *tftpServer) bootRequestId(client net.IP, piId string) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	for key, boot := range t.boots {
+		if now.Sub(boot.lastSeen) > tftpBootIdle {
+			delete(t.boots, key)
+		}
+	}
+
+	key := client.String() + "\x00" + piId
+	boot, exists := t.boots[key]
+	if !exists {
+		boot = &tftpBoot{requestId: uuid.New().String()}
+		t.boots[key] = boot
+	}
+	boot.lastSeen = now
+
+	return boot.requestId
+}
+
+//piIdOf returns the serial a file is requested under, or an empty string for files in the boot root
+func piIdOf(filename string) (string, string) {
+	filename = strings.TrimPrefix(path.Clean("/"+filename), "/")
+	parts := strings.SplitN(filename, "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return "", filename
+}
+
+//handleRequest answers a request from a new transfer ID (RFC 1350 section 4) on a fresh port
+func (t *tftpServer) handleRequest(localIP net.IP, remote *net.UDPAddr, packet []byte) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Printf("TFTP: unable to open transfer socket: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	if len(packet) < 2 {
+		return
+	}
+
+	switch binary.BigEndian.Uint16(packet) {
+	case tftpOpRRQ:
+		req, err := parseTftpRequest(packet[2:])
+		if err != nil {
+			t.sendError(conn, remote, tftpErrIllegalOp, err.Error())
+			log.Printf("TFTP: malformed request from %v\n", remote)
+			return
+		}
+
+		piId, _ := piIdOf(req.filename)
+		ctx := withRequestId(context.Background(), t.bootRequestId(remote.IP, piId))
+		err = t.serveRead(ctx, conn, remote, req)
+		if err != nil {
+			loggerFrom(ctx).Warn("TFTP transfer failed", "piId", piId, "filename", req.filename, "client", remote.String(), "error", err)
+		}
+	case tftpOpWRQ:
+		t.sendError(conn, remote, tftpErrAccess, "bakery does not accept uploads")
+	default:
+		t.sendError(conn, remote, tftpErrIllegalOp, "illegal TFTP operation")
+	}
+}
+
+func parseTftpRequest(payload []byte) (*tftpRequest, error) {
+	fields := bytes.Split(payload, []byte{0})
+	//a well formed request ends with a NUL, leaving an empty last field
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return nil, fmt.Errorf("malformed request")
+	}
+	fields = fields[:len(fields)-1]
+
+	req := &tftpRequest{
+		filename: string(fields[0]),
+		mode:     strings.ToLower(string(fields[1])),
+		options:  make(map[string]string),
+	}
+
+	for i := 2; i+1 < len(fields); i += 2 {
+		req.options[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+
+	return req, nil
+}
+
+//openFile maps {serial}/{filename} to the pi's boot files. Requests without a serial are served from the boot root,
+//older pis fetch bootcode.bin that way before they know to use their serial.
+func (t *tftpServer) openFile(ctx context.Context, filename string, remote *net.UDPAddr) (*bootFile, error) {
+	piId, filename := piIdOf(filename)
+	if piId != "" {
+		return t.files.openPiFile(ctx, piId, filename, remote.IP.String(), true)
+	}
+
+	fd, err := os.Open(path.Join(t.bootRoot, filename))
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := fd.Stat()
+	if err != nil || fi.IsDir() {
+		fd.Close()
+		return nil, os.ErrNotExist
+	}
+
+	return &bootFile{ReadSeeker: fd, name: filename, modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+func (t *tftpServer) serveRead(ctx context.Context, conn *net.UDPConn, remote *net.UDPAddr, req *tftpRequest) error {
+	//boot files are binary. Pis ask for octet, netascii would need line endings translated and is refused.
+	if req.mode != "octet" {
+		t.sendError(conn, remote, tftpErrIllegalOp, "unsupported mode "+req.mode+", use octet")
+		return fmt.Errorf("unsupported mode %v", req.mode)
+	}
+
+	file, err := t.openFile(ctx, req.filename, remote)
+	if err != nil {
+		t.sendError(conn, remote, tftpErrNotFound, "file not found")
+		return fmt.Errorf("%v: %v", req.filename, err)
+	}
+	defer file.Close()
+
+	blksize := tftpDefaultBlksize
+	timeout := tftpDefaultTimeout
+
+	//option negotiation (RFC 2347). Options we don't know are left out of the OACK.
+	oack := make(map[string]string)
+	if value, ok := req.options["blksize"]; ok {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < tftpMinBlksize {
+			t.sendError(conn, remote, tftpErrBadOptions, "invalid blksize")
+			return fmt.Errorf("invalid blksize %v", value)
+		}
+		if size > tftpMaxBlksize {
+			size = tftpMaxBlksize
+		}
+		blksize = size
+		oack["blksize"] = strconv.Itoa(blksize)
+	}
+
+	if _, ok := req.options["tsize"]; ok {
+		oack["tsize"] = strconv.FormatInt(file.size, 10)
+	}
+
+	if value, ok := req.options["timeout"]; ok {
+		seconds, err := strconv.Atoi(value)
+		if err == nil && seconds >= 1 && seconds <= 255 {
+			timeout = time.Duration(seconds) * time.Second
+			oack["timeout"] = value
+		}
+	}
+
+	if len(oack) > 0 {
+		packet := []byte{0, byte(tftpOpOACK)}
+		for name, value := range oack {
+			packet = append(packet, []byte(name)...)
+			packet = append(packet, 0)
+			packet = append(packet, []byte(value)...)
+			packet = append(packet, 0)
+		}
+
+		err = t.sendAndWaitForAck(conn, remote, packet, 0, timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	piId, _ := piIdOf(req.filename)
+	loggerFrom(ctx).Info("Sending boot file over TFTP", "piId", piId, "filename", req.filename, "client", remote.String())
+
+	block := uint16(1)
+	buf := make([]byte, blksize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.sendError(conn, remote, tftpErrNotDefined, "read error")
+			return err
+		}
+
+		packet := make([]byte, 4+n)
+		binary.BigEndian.PutUint16(packet, tftpOpDATA)
+		binary.BigEndian.PutUint16(packet[2:], block)
+		copy(packet[4:], buf[:n])
+
+		err = t.sendAndWaitForAck(conn, remote, packet, block, timeout)
+		if err != nil {
+			return err
+		}
+
+		//a short block marks the end of the transfer
+		if n < blksize {
+			return nil
+		}
+
+		block++ //wraps around to 0 for files larger than 65535 blocks, which is what most clients expect
+	}
+}
+
+//sendAndWaitForAck sends a packet and retransmits it until the matching ACK arrives
+func (t *tftpServer) sendAndWaitForAck(conn *net.UDPConn, remote *net.UDPAddr, packet []byte, block uint16, timeout time.Duration) error {
+	buf := make([]byte, 1024)
+
+	for attempt := 0; attempt < tftpRetries; attempt++ {
+		_, err := conn.WriteToUDP(packet, remote)
+		if err != nil {
+			return err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break //retransmit
+				}
+				return err
+			}
+
+			if !from.IP.Equal(remote.IP) || from.Port != remote.Port {
+				t.sendError(conn, from, tftpErrUnknownTID, "unknown transfer id")
+				continue
+			}
+
+			if n < 4 {
+				continue
+			}
+
+			switch binary.BigEndian.Uint16(buf) {
+			case tftpOpACK:
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+				//duplicate ACK for an earlier block. Ignore it to avoid the sorcerer's apprentice problem.
+			case tftpOpERROR:
+				return fmt.Errorf("client aborted transfer: %v", string(bytes.TrimRight(buf[4:n], "\x00")))
+			}
+		}
+	}
+
+	return fmt.Errorf("timeout waiting for ack of block %v", block)
+}
+
+func (t *tftpServer) sendError(conn *net.UDPConn, remote *net.UDPAddr, code uint16, message string) {
+	packet := make([]byte, 4, 5+len(message))
+	binary.BigEndian.PutUint16(packet, tftpOpERROR)
+	binary.BigEndian.PutUint16(packet[2:], code)
+	packet = append(packet, []byte(message)...)
+	packet = append(packet, 0)
+
+	conn.WriteToUDP(packet, remote)
+}
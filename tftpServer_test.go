@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestTftpServer(t *testing.T) (*tftpServer, *net.UDPAddr) {
+	t.Helper()
+
+	server := &tftpServer{
+		bootRoot:  t.TempDir(),
+		mutex:     &sync.Mutex{},
+		transfers: make(map[string]bool),
+		boots:     make(map[string]*tftpBoot),
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go server.serve(conn)
+
+	return server, conn.LocalAddr().(*net.UDPAddr)
+}
+
+//tftpClient is just enough of a TFTP client to read files from the server under test
+type tftpClient struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func newTftpClient(t *testing.T) *tftpClient {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &tftpClient{t: t, conn: conn}
+}
+
+func (c *tftpClient) sendRRQ(server *net.UDPAddr, filename, mode string, options ...string) {
+	packet := []byte{0, byte(tftpOpRRQ)}
+	for _, field := range append([]string{filename, mode}, options...) {
+		packet = append(packet, []byte(field)...)
+		packet = append(packet, 0)
+	}
+
+	_, err := c.conn.WriteToUDP(packet, server)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *tftpClient) receive(timeout time.Duration) ([]byte, *net.UDPAddr, error) {
+	buf := make([]byte, 65536)
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, from, err := c.conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf[:n], from, nil
+}
+
+func (c *tftpClient) ack(to *net.UDPAddr, block uint16) {
+	packet := make([]byte, 4)
+	binary.BigEndian.PutUint16(packet, tftpOpACK)
+	binary.BigEndian.PutUint16(packet[2:], block)
+
+	_, err := c.conn.WriteToUDP(packet, to)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+//readData acks blocks until the short block that ends the transfer and returns the file
+func (c *tftpClient) readData(first []byte, from *net.UDPAddr, blksize int) []byte {
+	var content []byte
+	packet := first
+	for block := uint16(1); ; block++ {
+		if binary.BigEndian.Uint16(packet) != tftpOpDATA || binary.BigEndian.Uint16(packet[2:]) != block {
+			c.t.Fatalf("expected DATA block %v, got %v", block, packet)
+		}
+		content = append(content, packet[4:]...)
+		c.ack(from, block)
+
+		if len(packet)-4 < blksize {
+			return content
+		}
+
+		var err error
+		packet, _, err = c.receive(time.Second)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+func writeTestBootFile(t *testing.T, server *tftpServer, name string, size int) []byte {
+	t.Helper()
+
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	err := ioutil.WriteFile(path.Join(server.bootRoot, name), content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+func TestTftpReadFile(t *testing.T) {
+	server, address := startTestTftpServer(t)
+	content := writeTestBootFile(t, server, "bootcode.bin", 1300)
+	client := newTftpClient(t)
+
+	client.sendRRQ(address, "bootcode.bin", "octet")
+	packet, from, err := client.receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Port == address.Port {
+		t.Error("the transfer runs on the port of the server instead of its own")
+	}
+
+	received := client.readData(packet, from, tftpDefaultBlksize)
+	if !bytes.Equal(received, content) {
+		t.Errorf("received %v bytes that don't match the %v bytes of the file", len(received), len(content))
+	}
+}
+
+func TestTftpOptionAck(t *testing.T) {
+	server, address := startTestTftpServer(t)
+	content := writeTestBootFile(t, server, "start.elf", 3000)
+	client := newTftpClient(t)
+
+	client.sendRRQ(address, "start.elf", "octet", "blksize", "1024", "tsize", "0")
+	packet, from, err := client.receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(packet) != tftpOpOACK {
+		t.Fatalf("expected an OACK, got %v", packet)
+	}
+
+	options, err := parseTftpRequest(append([]byte("file\x00mode\x00"), packet[2:]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.options["blksize"] != "1024" || options.options["tsize"] != "3000" {
+		t.Errorf("OACK has options %v", options.options)
+	}
+
+	client.ack(from, 0)
+	packet, _, err = client.receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet) != 4+1024 {
+		t.Errorf("first block has %v bytes of data, want 1024", len(packet)-4)
+	}
+
+	received := client.readData(packet, from, 1024)
+	if !bytes.Equal(received, content) {
+		t.Error("received data doesn't match the file")
+	}
+}
+
+func TestTftpMissingFile(t *testing.T) {
+	_, address := startTestTftpServer(t)
+	client := newTftpClient(t)
+
+	client.sendRRQ(address, "missing.bin", "octet")
+	packet, _, err := client.receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if binary.BigEndian.Uint16(packet) != tftpOpERROR || binary.BigEndian.Uint16(packet[2:]) != tftpErrNotFound {
+		t.Errorf("expected a file not found error, got %v", packet)
+	}
+}
+
+func TestTftpNetasciiRefused(t *testing.T) {
+	server, address := startTestTftpServer(t)
+	writeTestBootFile(t, server, "config.txt", 100)
+	client := newTftpClient(t)
+
+	client.sendRRQ(address, "config.txt", "netascii")
+	packet, _, err := client.receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if binary.BigEndian.Uint16(packet) != tftpOpERROR {
+		t.Errorf("expected an error, got %v", packet)
+	}
+}
+
+func TestTftpRetransmittedRequest(t *testing.T) {
+	server, address := startTestTftpServer(t)
+	content := writeTestBootFile(t, server, "kernel.img", 700)
+	client := newTftpClient(t)
+
+	client.sendRRQ(address, "kernel.img", "octet")
+	client.sendRRQ(address, "kernel.img", "octet")
+
+	packet, from, err := client.receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a second transfer would send its first block from another port before the first block is acked
+	extra, extraFrom, err := client.receive(300 * time.Millisecond)
+	if err == nil {
+		t.Fatalf("the retransmitted request started a second transfer from %v: %v", extraFrom, extra)
+	}
+
+	received := client.readData(packet, from, tftpDefaultBlksize)
+	if !bytes.Equal(received, content) {
+		t.Error("received data doesn't match the file")
+	}
+}
+
+func TestTftpBootRequestId(t *testing.T) {
+	server, _ := startTestTftpServer(t)
+	client := net.IPv4(10, 0, 0, 9)
+
+	first := server.bootRequestId(client, "12345678")
+	if server.bootRequestId(client, "12345678") != first {
+		t.Error("files of one boot got different request ids")
+	}
+	if server.bootRequestId(client, "87654321") == first {
+		t.Error("another pi booting from the same address got the same request id")
+	}
+	if server.bootRequestId(net.IPv4(10, 0, 0, 10), "12345678") == first {
+		t.Error("another client got the same request id")
+	}
+
+	//a pi that reboots after a while starts a new boot
+	server.boots[client.String()+"\x00"+"12345678"].lastSeen = time.Now().Add(-2 * tftpBootIdle)
+	if server.bootRequestId(client, "12345678") == first {
+		t.Error("a boot after the client went quiet got the request id of the previous boot")
+	}
+}
+
+func TestTftpServesPiFiles(t *testing.T) {
+	fakeRsync(t)
+	pm, fb := newTestPiManager(t)
+	ctx := context.Background()
+	bf := addTestBakeform(t, pm, fb, "raspbian")
+	err := ioutil.WriteFile(path.Join(fb.GetBootRoot(), "raspbian", "config.txt"), []byte("# {{.Hostname}}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fridgePi := pm.NewPi("00000000abcd")
+	err = fridgePi.Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := pm.GetPi("00000000abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.BakePi(ctx, pi, bf, bakeRequest{})
+
+	files, err := newFileServer(fb, pm, pm.diskManager, t.TempDir(), []string{"config.txt"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, address := startTestTftpServer(t)
+	server.files = files
+	client := newTftpClient(t)
+
+	//files under the serial of a baked pi are its boot files, rendered for it
+	client.sendRRQ(address, "00000000abcd/config.txt", "octet")
+	packet, from, err := client.receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := client.readData(packet, from, tftpDefaultBlksize)
+	if string(received) != "# pi-00000000abcd\n" {
+		t.Errorf("received %q", received)
+	}
+
+	//a pi that is not baked gets nothing
+	client.sendRRQ(address, "00000000ffff/config.txt", "octet")
+	packet, _, err = client.receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(packet) != tftpOpERROR {
+		t.Errorf("a pi in the fridge got %v", packet)
+	}
+}
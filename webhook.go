@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	webhookBakeCompleted = "bake.completed"
+	webhookBakeFailed    = "bake.failed"
+	webhookUnbaked       = "unbaked"
+)
+
+const webhookAttempts = 6
+
+//webhookPayload is posted to the webhooks as JSON. X-Bakery-Signature holds the HMAC-SHA256 of the X-Bakery-Timestamp header,
+//a dot and the body, so receivers can check the sender and refuse old deliveries that are replayed.
+type webhookPayload struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Pi    PiInfo    `json:"pi"`
+	Error string    `json:"error,omitempty"`
+}
+
+//webhookNotifier tells the configured webhooks, and the callback url of a bake request, when bakes complete or fail and when pis are unbaked
+type webhookNotifier struct {
+	urls          []string
+	secret        []byte
+	client        *http.Client
+	callbackHosts []string
+	//callbackClient refuses to connect to loopback and link-local addresses, whatever the callback host resolves to when it is posted to
+	callbackClient *http.Client
+}
+
+//newWebhookNotifier validates the configured webhooks. When callbackHosts is not empty only callback urls on those hosts are accepted.
+func newWebhookNotifier(urls []string, secret string, callbackHosts []string) (*webhookNotifier, error) {
+	if len(urls) > 0 && secret == "" {
+		return nil, fmt.Errorf("Please set WEBHOOK_SECRET, webhooks are always signed")
+	}
+
+	for _, u := range urls {
+		err := validateWebhookUrl(u)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: refuseInternalAddress}
+	return &webhookNotifier{
+		urls:          urls,
+		secret:        []byte(secret),
+		client:        &http.Client{Timeout: 10 * time.Second},
+		callbackHosts: callbackHosts,
+		callbackClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+	}, nil
+}
+
+func validateWebhookUrl(webhookUrl string) error {
+	u, err := url.Parse(webhookUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid webhook url %v", webhookUrl)
+	}
+	return nil
+}
+
+//validateCallbackUrl checks the callback url of a bake request. It has to be on one of the allowed hosts, if any are configured,
+//and may not point at loopback or link-local addresses.
+func (n *webhookNotifier) validateCallbackUrl(callbackUrl string) error {
+	err := validateWebhookUrl(callbackUrl)
+	if err != nil {
+		return err
+	}
+
+	u, _ := url.Parse(callbackUrl)
+	host := u.Hostname()
+	if len(n.callbackHosts) > 0 && !slices.Contains(n.callbackHosts, strings.ToLower(host)) {
+		return fmt.Errorf("Callback host %v is not allowed", host)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return fmt.Errorf("Unable to resolve callback host %v: %v", host, err)
+	}
+	for _, ip := range ips {
+		if internalAddress(ip) {
+			return fmt.Errorf("Callback url %v points at %v, which is not allowed", callbackUrl, ip)
+		}
+	}
+	return nil
+}
+
+//internalAddress reports if ip is loopback, link-local, unspecified or multicast. Callbacks are never posted to such addresses.
+func internalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast()
+}
+
+//refuseInternalAddress is the dialer control of the callback client. It runs after the host is resolved, so a callback host
+//that resolves to an internal address once it has been accepted, or a redirect to one, is refused too.
+func refuseInternalAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || internalAddress(ip) {
+		return fmt.Errorf("Refusing to post callback to %v", address)
+	}
+	return nil
+}
+
+//Notify posts an event about a pi to the global webhooks and the callback url, if any. Delivery happens in the background.
+func (n *webhookNotifier) Notify(event string, pi PiInfo, callbackUrl string, cause error) {
+	if n == nil {
+		return
+	}
+
+	if len(n.urls) == 0 && callbackUrl == "" {
+		return
+	}
+
+	payload := webhookPayload{
+		Event: event,
+		Time:  time.Now().UTC(),
+		Pi:    pi,
+	}
+	if cause != nil {
+		payload.Error = cause.Error()
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Unable to build %v webhook for pi %v: %v\n", event, pi.Id, err)
+		return
+	}
+
+	for _, target := range n.urls {
+		go n.deliver(n.client, target, event, body)
+	}
+	if callbackUrl != "" {
+		go n.deliver(n.callbackClient, callbackUrl, event, body)
+	}
+}
+
+//signs reports if webhooks can be signed. Callback urls are only accepted when they can be.
+func (n *webhookNotifier) signs() bool {
+	return n != nil && len(n.secret) > 0
+}
+
+func (n *webhookNotifier) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//deliver posts the body until the webhook accepts it. Failures are retried with exponential backoff, client errors other than 429 are not.
+func (n *webhookNotifier) deliver(client *http.Client, target, event string, body []byte) {
+	backoff := 1 * time.Second
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		retry, err := n.post(client, target, event, body)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt == webhookAttempts {
+			log.Printf("Giving up on %v webhook to %v after %v attempts: %v\n", event, target, attempt, err)
+			return
+		}
+
+		log.Printf("%v webhook to %v failed, retrying in %v: %v\n", event, target, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (n *webhookNotifier) post(client *http.Client, target, event string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bakery-Event", event)
+
+	//every attempt is signed with the time it is sent
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Bakery-Timestamp", timestamp)
+	req.Header.Set("X-Bakery-Signature", n.sign(timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%v", resp.Status)
+	}
+
+	return false, nil
+}
+
+//parseWebhookUrls splits a comma separated list of urls
+func parseWebhookUrls(list string) []string {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
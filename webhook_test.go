@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhooksNeedSecret(t *testing.T) {
+	_, err := newWebhookNotifier([]string{"https://example.com/hook"}, "", nil)
+	if err == nil {
+		t.Error("webhooks were configured without a secret")
+	}
+
+	n, err := newWebhookNotifier(nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.signs() {
+		t.Error("a notifier without a secret claims to sign")
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan delivery, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		deliveries <- delivery{r.Header, body}
+	}))
+	defer server.Close()
+
+	n, err := newWebhookNotifier([]string{server.URL}, "s3cret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(webhookBakeCompleted, PiInfo{Id: "12345678"}, "", nil)
+
+	var d delivery
+	select {
+	case d = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was not delivered")
+	}
+
+	timestamp := d.header.Get("X-Bakery-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Errorf("X-Bakery-Timestamp is %q", timestamp)
+	}
+
+	//what a receiver checks
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(d.body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if d.header.Get("X-Bakery-Signature") != expected {
+		t.Errorf("X-Bakery-Signature is %q, want %q", d.header.Get("X-Bakery-Signature"), expected)
+	}
+	if d.header.Get("X-Bakery-Event") != webhookBakeCompleted {
+		t.Errorf("X-Bakery-Event is %q", d.header.Get("X-Bakery-Event"))
+	}
+}
+
+func TestCallbackUrls(t *testing.T) {
+	n, err := newWebhookNotifier(nil, "s3cret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, callbackUrl := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://[::1]/hook", "http://169.254.169.254/latest/meta-data", "http://0.0.0.0/hook", "ftp://10.0.0.9/hook"} {
+		if n.validateCallbackUrl(callbackUrl) == nil {
+			t.Errorf("callback url %v was accepted", callbackUrl)
+		}
+	}
+	err = n.validateCallbackUrl("http://10.0.0.9:8080/hook")
+	if err != nil {
+		t.Errorf("callback url on the local network was refused: %v", err)
+	}
+
+	n, err = newWebhookNotifier(nil, "s3cret", []string{"ci.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.validateCallbackUrl("http://10.0.0.9:8080/hook") == nil {
+		t.Error("callback url on a host that is not allowed was accepted")
+	}
+}
+
+func TestCallbacksAreNotPostedToLoopback(t *testing.T) {
+	posted := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- true
+	}))
+	defer server.Close()
+
+	n, err := newWebhookNotifier(nil, "s3cret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the host may resolve to loopback after the callback url was accepted
+	_, err = n.post(n.callbackClient, server.URL, webhookBakeCompleted, []byte("{}"))
+	if err == nil {
+		t.Error("the callback was posted to a loopback address")
+	}
+	select {
+	case <-posted:
+		t.Error("the server received the callback")
+	default:
+	}
+}